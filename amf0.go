@@ -0,0 +1,598 @@
+package amf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Read an AMF0 value. The avmplus type marker switches to AMF3 for one value.
+func (cxt *Decoder) readValueAmf0() interface{} {
+
+	typeMarker := cxt.ReadByte()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	cxt.markers = append(cxt.markers, typeMarker)
+	defer cxt.popMarker()
+
+	if !cxt.checkLimit("Nesting depth", len(cxt.markers), cxt.Limits.MaxDepth) {
+		return nil
+	}
+
+	// Type markers
+	switch typeMarker {
+	case amf0_numberType:
+		return cxt.ReadFloat64()
+	case amf0_booleanType:
+		val := cxt.ReadUint8()
+		return val != 0
+	case amf0_stringType:
+		return cxt.ReadString()
+	case amf0_longStringType:
+		return cxt.readLongStringAmf0()
+	case amf0_objectType:
+		result := make(map[string]interface{})
+
+		// Store the object in the table before doing any decoding.
+		cxt.storeAmf0ObjectInTable(result)
+
+		cxt.readPropertiesAmf0(result)
+		return result
+	case amf0_typedObjectType:
+		return cxt.readTypedObjectAmf0()
+	case amf0_ecmaArrayType:
+		// The count is only a hint, the properties end with an object end marker
+		// like an object's.
+		cxt.ReadUint32()
+		result := make(map[string]interface{})
+		cxt.storeAmf0ObjectInTable(result)
+		cxt.readPropertiesAmf0(result)
+		return result
+	case amf0_strictArrayType:
+		return cxt.readStrictArrayAmf0()
+	case amf0_dateType:
+		millis := cxt.ReadFloat64()
+
+		// Time zone, which should always be 0 and is ignored.
+		cxt.ReadUint16()
+
+		if cxt.errored() {
+			return nil
+		}
+		return millisecondsToTime(millis)
+	case amf0_referenceType:
+		index := int(cxt.ReadUint16())
+		if cxt.errored() {
+			return nil
+		}
+		if index >= len(cxt.amf0ObjectTable) {
+			cxt.saveError(os.NewError(fmt.Sprintf("Invalid AMF0 object reference: %d", index)))
+			return nil
+		}
+		result := cxt.amf0ObjectTable[index]
+		if _, unfinished := result.(unfinishedValue); unfinished {
+			cxt.saveError(os.NewError(fmt.Sprintf(
+				"Reference to AMF0 object %d while it's being read", index)))
+			return nil
+		}
+		cxt.noteReference(result)
+		return result
+	case amf0_xmlObjectType:
+		return XMLDocument(cxt.readLongStringAmf0())
+	case amf0_nullType, amf0_undefinedType, amf0_unsupporedType:
+		return nil
+	case amf0_avmPlusObjectType:
+		return cxt.ReadValueAmf3()
+	}
+
+	cxt.saveError(os.NewError(fmt.Sprintf("AMF0 type marker was not supported: %d", typeMarker)))
+	return nil
+}
+
+func (cxt *Decoder) readLongStringAmf0() string {
+	length := int(cxt.ReadUint32())
+	if cxt.errored() {
+		return ""
+	}
+	return cxt.ReadStringKnownLength(length)
+}
+
+func (cxt *Decoder) storeAmf0ObjectInTable(obj interface{}) {
+	if !cxt.checkReferences(len(cxt.amf0ObjectTable)) {
+		return
+	}
+	cxt.amf0ObjectTable = append(cxt.amf0ObjectTable, obj)
+}
+
+// Read name-value pairs into result, up to the empty name and object end marker
+// that close an object or ECMA array.
+func (cxt *Decoder) readPropertiesAmf0(result map[string]interface{}) {
+	for {
+		name := cxt.ReadString()
+		if cxt.errored() {
+			return
+		}
+		if name == "" {
+			if marker := cxt.ReadByte(); marker != amf0_objectEndType && !cxt.errored() {
+				cxt.saveError(os.NewError(fmt.Sprintf(
+					"Expected object end marker, found: %d", marker)))
+			}
+			return
+		}
+		if !cxt.checkCollectionSize(len(result) + 1) {
+			return
+		}
+
+		cxt.pushPathName(name)
+		result[name] = cxt.readValueAmf0()
+		cxt.popPath()
+
+		if cxt.errored() {
+			return
+		}
+	}
+}
+
+// Read an object with a class name. Its properties are all stored as dynamic
+// fields, since AMF0 has no traits. If the class is registered, an instance of the
+// registered type is returned instead.
+func (cxt *Decoder) readTypedObjectAmf0() interface{} {
+	className := cxt.ReadString()
+	if cxt.errored() {
+		return nil
+	}
+
+	object := &AvmObject{}
+	object.class = &AvmClass{className, false, true, nil}
+	object.dynamicFields = make(map[string]interface{})
+
+	tableIndex := len(cxt.amf0ObjectTable)
+	cxt.storeAmf0ObjectInTable(object)
+
+	cxt.beginObject(object)
+	cxt.readPropertiesAmf0(object.dynamicFields)
+	pending := cxt.endObject()
+	if cxt.errored() {
+		return nil
+	}
+
+	// Later references get the resolved value too.
+	result := cxt.resolveObject(pending)
+	cxt.amf0ObjectTable[tableIndex] = result
+	return result
+}
+
+func (cxt *Decoder) readStrictArrayAmf0() interface{} {
+	elementCount := int(cxt.ReadUint32())
+	if cxt.errored() || !cxt.checkCollectionSize(elementCount) {
+		return nil
+	}
+
+	if elementCount <= maxPreallocated {
+		result := make([]interface{}, elementCount)
+
+		// Store the array in the table before doing any decoding. The slice shares
+		// its backing array, so the stored copy sees the elements as they're read.
+		cxt.storeAmf0ObjectInTable(result)
+
+		for i := 0; i < elementCount && !cxt.errored(); i++ {
+			cxt.pushPathIndex(i)
+			result[i] = cxt.readValueAmf0()
+			cxt.popPath()
+		}
+		return result
+	}
+
+	// Longer arrays grow as they're read, so they're only entered in the table once
+	// they're finished, and can't contain references to themselves.
+	index := len(cxt.amf0ObjectTable)
+	cxt.storeAmf0ObjectInTable(unfinishedValue{})
+
+	result := make([]interface{}, 0, maxPreallocated)
+	for i := 0; i < elementCount && !cxt.errored(); i++ {
+		cxt.pushPathIndex(i)
+		result = append(result, cxt.readValueAmf0())
+		cxt.popPath()
+	}
+	if cxt.errored() {
+		return nil
+	}
+	cxt.amf0ObjectTable[index] = result
+	return result
+}
+
+// Clear the reference tables. Each header and body of a remoting envelope is
+// encoded with fresh tables.
+func (cxt *Decoder) resetTables() {
+	cxt.stringTable = nil
+	cxt.classTable = nil
+	cxt.objectTable = nil
+	cxt.amf0ObjectTable = nil
+}
+
+// Start new reference tables, so that the next value written doesn't refer to
+// earlier ones.
+func (cxt *Encoder) resetTables() {
+	cxt.stringTable = make(map[string]int)
+	cxt.objectTable = make(map[objectKey]int)
+	cxt.objectCount = 0
+	cxt.traitTable = make(map[*AvmClass]int)
+	cxt.amf0ObjectTable = make(map[objectKey]int)
+	cxt.amf0ObjectCount = 0
+}
+
+// Write an AMF0 value. Values that AMF0 has no type for (such as ByteArrays,
+// Vectors and Externalizable objects) are written as AMF3, after the avmplus type
+// marker.
+func (cxt *Encoder) WriteValueAmf0(value interface{}) os.Error {
+
+	if value == nil {
+		return cxt.writeByte(amf0_nullType)
+	}
+
+	return cxt.writeReflectedValueAmf0(reflect.ValueOf(value))
+}
+
+func (cxt *Encoder) writeReflectedValueAmf0(value reflect.Value) os.Error {
+
+	if value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return cxt.writeByte(amf0_nullType)
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return cxt.writeByte(amf0_nullType)
+	}
+
+	// Types can substitute another value for themselves.
+	if marshaler, ok := implementation(value, marshalerType); ok {
+		substitute, err := marshaler.(Marshaler).MarshalAMF()
+		if err != nil {
+			return err
+		}
+		return cxt.WriteValueAmf0(substitute)
+	}
+
+	if value.Kind() == reflect.Ptr && isBuiltinValueType(value.Type().Elem()) {
+		return cxt.writeReflectedValueAmf0(value.Elem())
+	}
+
+	if cxt.needsAmf3(value) {
+		cxt.writeByte(amf0_avmPlusObjectType)
+		return cxt.writeReflectedValueAmf3(value)
+	}
+
+	switch value.Type() {
+	case undefinedType:
+		return cxt.writeByte(amf0_undefinedType)
+	case timeType:
+		cxt.writeByte(amf0_dateType)
+		cxt.WriteFloat64(timeToMilliseconds(value.Interface().(time.Time)))
+
+		// Time zone, which is always sent as 0.
+		return cxt.WriteUint16(0)
+	case xmlDocumentType:
+		cxt.writeByte(amf0_xmlObjectType)
+		return cxt.writeLongStringAmf0(value.String())
+	case avmObjectType:
+		return cxt.writeAvmObjectAmf0(value)
+	case avmObjectType.Elem():
+		object := value.Interface().(AvmObject)
+		return cxt.writeAvmObjectAmf0(reflect.ValueOf(&object))
+	case avmArrayType:
+		return cxt.writeMixedArrayAmf0(value)
+	}
+
+	// Otherwise, types that can write themselves as text are sent as strings.
+	if textMarshaler, ok := implementation(value, textMarshalerType); ok {
+		text, err := textMarshaler.(TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		return cxt.writeStringAmf0(string(text))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return cxt.writeStringAmf0(value.String())
+	case reflect.Bool:
+		cxt.writeByte(amf0_booleanType)
+		if value.Bool() {
+			return cxt.writeByte(1)
+		}
+		return cxt.writeByte(0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cxt.writeIntAmf0(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return cxt.writeUintAmf0(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		cxt.writeByte(amf0_numberType)
+		return cxt.WriteFloat64(value.Float())
+	case reflect.Slice, reflect.Array:
+		return cxt.writeStrictArrayAmf0(value)
+	case reflect.Map:
+		return cxt.writeReflectedMapAmf0(value)
+	case reflect.Struct:
+		return cxt.writeReflectedStructAmf0(value)
+	case reflect.Ptr:
+		if value.Elem().Kind() == reflect.Struct && value.Elem().Type() != timeType {
+			return cxt.writeReflectedStructAmf0(value)
+		}
+		return cxt.writeReflectedValueAmf0(value.Elem())
+	}
+
+	return os.NewError(fmt.Sprintf("writeReflectedValueAmf0 doesn't support kind: %v",
+		value.Kind().String()))
+}
+
+// Check if value has to be written as AMF3, either because AMF0 has no type for
+// it, or because SwitchToAmf3 is set and it isn't a simple value.
+func (cxt *Encoder) needsAmf3(value reflect.Value) bool {
+	valueType := value.Type()
+
+	if reflect.PtrTo(valueType).Implements(externalizableType) ||
+		valueType.Implements(externalizableType) {
+		return true
+	}
+
+	switch valueType {
+	case undefinedType:
+		return false
+	case xmlType, avmVectorType, avmDictionaryType, intVectorType, intVectorType.Elem(),
+		uintVectorType, uintVectorType.Elem(), doubleVectorType, doubleVectorType.Elem():
+		return true
+	case timeType, xmlDocumentType, avmArrayType:
+		return cxt.SwitchToAmf3
+	case avmObjectType:
+		object := value.Interface().(*AvmObject)
+		return cxt.SwitchToAmf3 || (object.class != nil && object.class.externalizable)
+	case avmObjectType.Elem():
+		object := value.Interface().(AvmObject)
+		return cxt.SwitchToAmf3 || (object.class != nil && object.class.externalizable)
+	}
+
+	if value.Kind() == reflect.Ptr && isBuiltinValueType(valueType.Elem()) {
+		return cxt.needsAmf3(value.Elem())
+	}
+
+	if _, ok := implementation(value, textMarshalerType); ok {
+		return false
+	}
+
+	switch value.Kind() {
+	case reflect.Slice:
+		return cxt.SwitchToAmf3 || cxt.UseArrayCollection ||
+			valueType.Elem().Kind() == reflect.Uint8
+	case reflect.Array:
+		return cxt.SwitchToAmf3 || cxt.UseArrayCollection
+	case reflect.Map:
+		return cxt.SwitchToAmf3 || valueType.Key().Kind() != reflect.String
+	case reflect.Struct:
+		return cxt.SwitchToAmf3
+	case reflect.Ptr:
+		return cxt.needsAmf3(value.Elem())
+	}
+	return false
+}
+
+// Assign the next AMF0 object index to this value. If the value was already
+// written, then write a reference to it and return true, in which case the caller
+// shouldn't write anything else. AMF0 references are 16 bits, so values past the
+// first 65536 are always written in full.
+func (cxt *Encoder) writeObjectReferenceAmf0(value reflect.Value) bool {
+	key, hasIdentity := identityKey(value)
+
+	if hasIdentity {
+		if index, found := cxt.amf0ObjectTable[key]; found {
+			cxt.writeByte(amf0_referenceType)
+			cxt.WriteUint16(uint16(index))
+			return true
+		}
+		if cxt.amf0ObjectCount <= math.MaxUint16 {
+			cxt.amf0ObjectTable[key] = cxt.amf0ObjectCount
+		}
+	}
+
+	cxt.amf0ObjectCount++
+	return false
+}
+
+func (cxt *Encoder) writeStringAmf0(s string) os.Error {
+	if len(s) > math.MaxUint16 {
+		cxt.writeByte(amf0_longStringType)
+		return cxt.writeLongStringAmf0(s)
+	}
+	cxt.writeByte(amf0_stringType)
+	return cxt.WriteString(s)
+}
+
+func (cxt *Encoder) writeLongStringAmf0(s string) os.Error {
+	cxt.WriteUint32(uint32(len(s)))
+	_, err := cxt.stream.Write([]byte(s))
+	return err
+}
+
+func (cxt *Encoder) writeIntAmf0(number int64) os.Error {
+	magnitude := uint64(number)
+	if number < 0 {
+		magnitude = uint64(-number)
+	}
+	if cxt.ErrorOnPrecisionLoss && !isExactAsDouble(magnitude) {
+		return os.NewError(fmt.Sprintf("Integer can't be written as a double without "+
+			"losing precision: %d", number))
+	}
+
+	cxt.writeByte(amf0_numberType)
+	return cxt.WriteFloat64(float64(number))
+}
+
+func (cxt *Encoder) writeUintAmf0(number uint64) os.Error {
+	if cxt.ErrorOnPrecisionLoss && !isExactAsDouble(number) {
+		return os.NewError(fmt.Sprintf("Integer can't be written as a double without "+
+			"losing precision: %d", number))
+	}
+
+	cxt.writeByte(amf0_numberType)
+	return cxt.WriteFloat64(float64(number))
+}
+
+// Write one name-value pair of an object or ECMA array.
+func (cxt *Encoder) writePropertyAmf0(name string, value reflect.Value) os.Error {
+	if name == "" {
+		return os.NewError("Can't write an empty property name in AMF0")
+	}
+	cxt.WriteString(name)
+	return cxt.writeReflectedValueAmf0(value)
+}
+
+// Write the empty name and object end marker that close an object or ECMA array.
+func (cxt *Encoder) writeObjectEndAmf0() os.Error {
+	cxt.WriteString("")
+	return cxt.writeByte(amf0_objectEndType)
+}
+
+// Write the type marker of an object: an anonymous object if there's no class
+// name, otherwise a typed object.
+func (cxt *Encoder) writeObjectHeaderAmf0(className string) os.Error {
+	if className == "" {
+		return cxt.writeByte(amf0_objectType)
+	}
+	cxt.writeByte(amf0_typedObjectType)
+	return cxt.WriteString(className)
+}
+
+// Write a struct, or a pointer to a struct, as a typed object using the same class
+// name as AMF3. Structs of anonymous types are written as anonymous objects.
+func (cxt *Encoder) writeReflectedStructAmf0(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf0(value) {
+		return nil
+	}
+
+	value = reflect.Indirect(value)
+	trait := cxt.traitForType(value.Type())
+
+	cxt.writeObjectHeaderAmf0(trait.class.name)
+
+	for _, field := range trait.sealed {
+		if err := cxt.writePropertyAmf0(field.name, value.Field(field.index)); err != nil {
+			return err
+		}
+	}
+	for _, field := range trait.optional {
+		fieldValue := value.Field(field.index)
+		if isEmptyValue(fieldValue) {
+			continue
+		}
+		if err := cxt.writePropertyAmf0(field.name, fieldValue); err != nil {
+			return err
+		}
+	}
+
+	return cxt.writeObjectEndAmf0()
+}
+
+// Write a Go map with string keys as an anonymous object.
+func (cxt *Encoder) writeReflectedMapAmf0(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf0(value) {
+		return nil
+	}
+
+	cxt.writeByte(amf0_objectType)
+
+	keys := value.MapKeys()
+	if cxt.SortMapKeys {
+		sort.Sort(mapKeysByName(keys))
+	}
+
+	for _, key := range keys {
+		if err := cxt.writePropertyAmf0(key.String(), value.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+
+	return cxt.writeObjectEndAmf0()
+}
+
+// Write an AvmObject (given as a *AvmObject value) with its sealed and dynamic
+// fields as properties.
+func (cxt *Encoder) writeAvmObjectAmf0(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf0(value) {
+		return nil
+	}
+
+	object := value.Interface().(*AvmObject)
+	if object.class == nil {
+		return os.NewError("writeAvmObjectAmf0 called with an AvmObject that has no fields")
+	}
+
+	cxt.writeObjectHeaderAmf0(object.class.name)
+
+	for i, name := range object.class.properties {
+		if err := cxt.writePropertyAmf0(name,
+			reflect.ValueOf(&object.staticFields[i]).Elem()); err != nil {
+			return err
+		}
+	}
+	for _, name := range cxt.sortedFieldNames(object.dynamicFields) {
+		fieldValue := object.dynamicFields[name]
+		if err := cxt.writePropertyAmf0(name, reflect.ValueOf(&fieldValue).Elem()); err != nil {
+			return err
+		}
+	}
+
+	return cxt.writeObjectEndAmf0()
+}
+
+// Write an AvmArray as an ECMA array. The dense elements are written first, named
+// by their index.
+func (cxt *Encoder) writeMixedArrayAmf0(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf0(value) {
+		return nil
+	}
+
+	array := value.Interface().(*AvmArray)
+
+	cxt.writeByte(amf0_ecmaArrayType)
+	cxt.WriteUint32(uint32(len(array.elements) + len(array.fields)))
+
+	for i := range array.elements {
+		if err := cxt.writePropertyAmf0(strconv.Itoa(i),
+			reflect.ValueOf(&array.elements[i]).Elem()); err != nil {
+			return err
+		}
+	}
+	for _, name := range cxt.sortedFieldNames(array.fields) {
+		fieldValue := array.fields[name]
+		if err := cxt.writePropertyAmf0(name, reflect.ValueOf(&fieldValue).Elem()); err != nil {
+			return err
+		}
+	}
+
+	return cxt.writeObjectEndAmf0()
+}
+
+func (cxt *Encoder) writeStrictArrayAmf0(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf0(value) {
+		return nil
+	}
+
+	cxt.writeByte(amf0_strictArrayType)
+	cxt.WriteUint32(uint32(value.Len()))
+
+	for i := 0; i < value.Len(); i++ {
+		if err := cxt.writeReflectedValueAmf0(value.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAmf0(blobStr string) (interface{}, os.Error, int) {
+	blob, _ := hex.DecodeString(blobStr)
+	reader := bytes.NewBuffer(blob)
+	decoder := NewDecoder(reader, 0)
+	value := decoder.ReadValue()
+	return value, decoder.decodeError, reader.Len()
+}
+
+func testReadAmf0(t *testing.T, blobStr string, expectedStr string) {
+	val, err, leftover := readAmf0(blobStr)
+	valStr := fmt.Sprintf("%v", val)
+
+	if valStr != expectedStr {
+		t.Errorf("Read result of '%s' didn't match expected '%s' for binary blob %s",
+			valStr, expectedStr, blobStr)
+	}
+
+	if err != nil {
+		t.Errorf("Received error while expecting to unpack %s -> '%s': %v", blobStr,
+			expectedStr, err)
+	}
+
+	if leftover != 0 {
+		t.Errorf("Leftover bytes (%d) while expecting to unpack %s -> '%s'", leftover,
+			blobStr, expectedStr)
+	}
+}
+
+func expectReadErrorAmf0(t *testing.T, blobStr string) {
+	_, err, _ := readAmf0(blobStr)
+
+	if err == nil {
+		t.Errorf("Expected error but err == nil, for blob: %s", blobStr)
+	}
+}
+
+func TestReadSimpleValuesAmf0(t *testing.T) {
+	testReadAmf0(t, "003ff0000000000000", "1")
+	testReadAmf0(t, "0101", "true")
+	testReadAmf0(t, "0100", "false")
+	testReadAmf0(t, "05", "<nil>")
+	testReadAmf0(t, "06", "<nil>")
+	testReadAmf0(t, "0d", "<nil>")
+	testReadAmf0(t, "020003616263", "abc")
+	testReadAmf0(t, "0c00000003616263", "abc")
+	testReadAmf0(t, "0b00000000000000000000", "Thu Jan  1 00:00:00 UTC 1970")
+	testReadAmf0(t, "0f000000043c612f3e", "<a/>")
+
+	// Switch to AMF3 for one value.
+	testReadAmf0(t, "110401", "1")
+}
+
+func TestReadObjectsAmf0(t *testing.T) {
+	testReadAmf0(t, "03000009", "map[]")
+	testReadAmf0(t, "030001610101000009", "map[a:true]")
+
+	// ECMA array, the count is only a hint.
+	testReadAmf0(t, "08000000050001610101000009", "map[a:true]")
+
+	testReadAmf0(t, "0a00000002020001610101", "[a true]")
+
+	// The array is entry 0 and the object entry 1 in the reference table.
+	testReadAmf0(t, "0a00000002030001610101000009070001", "[map[a:true] map[a:true]]")
+
+	value, err, _ := readAmf0("100003466f6f0001610101000009")
+	object, ok := value.(*AvmObject)
+	if !ok || err != nil {
+		t.Fatalf("Expected an AvmObject, got: %v (err = %v)", value, err)
+	}
+	if a, _ := object.Get("a"); object.ClassName() != "Foo" || a != true {
+		t.Errorf("Wrong typed object: %s %v", object.ClassName(), a)
+	}
+}
+
+func TestReadErrorsAmf0(t *testing.T) {
+	// Movie clips and record sets are reserved.
+	expectReadErrorAmf0(t, "04")
+	expectReadErrorAmf0(t, "0e")
+
+	// Object end marker outside of an object.
+	expectReadErrorAmf0(t, "09")
+
+	// Missing object end marker.
+	expectReadErrorAmf0(t, "03000005")
+
+	// Reference to an entry that doesn't exist.
+	expectReadErrorAmf0(t, "070000")
+}
+
+func testWriteAmf0(t *testing.T, encoder *Encoder, value interface{}, expectedBlob string) {
+	expectedBytes, _ := hex.DecodeString(expectedBlob)
+	writer := bytes.NewBuffer(make([]byte, 0, 1))
+
+	if encoder == nil {
+		encoder = NewEncoder(writer)
+	} else {
+		encoder.stream = writer
+	}
+	err := encoder.WriteValueAmf0(value)
+
+	resultBytes := writer.Bytes()
+	if bytes.Compare(expectedBytes, resultBytes) != 0 {
+		t.Errorf("Write result of '%x' didn't match expected '%s' for input %v",
+			resultBytes, expectedBlob, value)
+	}
+
+	if err != nil {
+		t.Errorf("Received error while trying to write '%v': %v", value, err)
+	}
+}
+
+func TestWriteSimpleValuesAmf0(t *testing.T) {
+	testWriteAmf0(t, nil, nil, "05")
+	testWriteAmf0(t, nil, Undefined{}, "06")
+	testWriteAmf0(t, nil, true, "0101")
+	testWriteAmf0(t, nil, 1, "003ff0000000000000")
+	testWriteAmf0(t, nil, 1.5, "003ff8000000000000")
+	testWriteAmf0(t, nil, "abc", "020003616263")
+	testWriteAmf0(t, nil, *time.SecondsToUTC(0), "0b00000000000000000000")
+	testWriteAmf0(t, nil, XMLDocument("<a/>"), "0f000000043c612f3e")
+
+	// Values with no AMF0 type switch to AMF3.
+	testWriteAmf0(t, nil, []byte{1, 2, 3}, "110c07010203")
+	testWriteAmf0(t, nil, XML("<a/>"), "110b093c612f3e")
+
+	// Strings too long for a 16-bit length.
+	long := strings.Repeat("a", 70000)
+	data, _ := MarshalAmf0(long)
+	if hex.EncodeToString(data[:5]) != "0c00011170" || len(data) != 70005 {
+		t.Errorf("Wrong long string header: %x", data[:5])
+	}
+	var result string
+	if err := UnmarshalAmf0(data, &result); err != nil || result != long {
+		t.Errorf("Long string didn't round trip, err = %v", err)
+	}
+}
+
+func TestWriteObjectsAmf0(t *testing.T) {
+	testWriteAmf0(t, nil, []interface{}{"a", true}, "0a00000002020001610101")
+	testWriteAmf0(t, nil, map[string]interface{}{"a": true}, "030001610101000009")
+
+	// Structs are typed objects, named like their AMF3 class.
+	testWriteAmf0(t, nil, Size{2, 3}, "100004"+"53697a65"+"00055769647468"+
+		"004000000000000000"+"0006486569676874"+"004008000000000000"+"000009")
+
+	// The array is entry 0 and the map entry 1 in the reference table.
+	shared := map[string]interface{}{"a": true}
+	testWriteAmf0(t, nil, []interface{}{shared, shared},
+		"0a00000002"+"030001610101000009"+"070001")
+
+	array := &AvmArray{}
+	array.elements = []interface{}{"x"}
+	array.fields = map[string]interface{}{"b": false}
+	testWriteAmf0(t, nil, array, "0800000002"+"000130"+"02000178"+"000162"+"0100"+"000009")
+
+	encoder := NewEncoder(nil)
+	encoder.SwitchToAmf3 = true
+	testWriteAmf0(t, encoder, map[string]interface{}{"a": true}, "110a0b0103610301")
+	testWriteAmf0(t, encoder, "abc", "020003616263")
+}
+
+func TestRoundTripAmf0(t *testing.T) {
+	value := map[string]interface{}{
+		"list": []interface{}{1.0, "two", nil},
+		"when": time.SecondsToUTC(1300000000),
+	}
+	data, err := MarshalAmf0(value)
+	if err != nil {
+		t.Fatalf("MarshalAmf0 returned error: %v", err)
+	}
+	result, err, _ := readAmf0(hex.EncodeToString(data))
+	if !reflect.DeepEqual(result, value) || err != nil {
+		t.Errorf("Round trip gave %v (err = %v)", result, err)
+	}
+}
+
+func TestTypedObjectsAmf0(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.example.Size", Size{})
+
+	buffer := bytes.NewBuffer(nil)
+	encoder := NewEncoder(buffer)
+	encoder.Registry = registry
+	encoder.WriteValueAmf0(&Size{2, 3})
+
+	blob := hex.EncodeToString(buffer.Bytes())
+	if !strings.HasPrefix(blob, "100010"+hex.EncodeToString([]byte("com.example.Size"))) {
+		t.Errorf("Registered type wasn't written with its alias: %s", blob)
+	}
+
+	decoder := NewDecoder(buffer, 0)
+	decoder.Registry = registry
+	value := decoder.ReadValue()
+	if size, ok := value.(Size); !ok || size.Width != 2 || size.Height != 3 {
+		t.Errorf("Expected a Size, got: %#v (err = %v)", value, decoder.decodeError)
+	}
+}
@@ -0,0 +1,62 @@
+package amf
+
+import (
+	"os"
+	"reflect"
+)
+
+/*
+   Flex wraps collections in externalizable classes. Each of these classes writes a
+   single AMF3 value as its external data (the source array, or the proxied object),
+   so when decoding we just unwrap them and return the value inside.
+*/
+
+const (
+	arrayCollectionClassName = "flex.messaging.io.ArrayCollection"
+	arrayListClassName       = "flex.messaging.io.ArrayList"
+	objectProxyClassName     = "flex.messaging.io.ObjectProxy"
+)
+
+var arrayCollectionClass = &AvmClass{arrayCollectionClassName, true, false, nil}
+
+func isUnwrappedExternalClass(name string) bool {
+	switch name {
+	case arrayCollectionClassName, arrayListClassName, objectProxyClassName:
+		return true
+	}
+	return false
+}
+
+func (cxt *Decoder) readUnwrappedExternalAmf3() interface{} {
+
+	// Store a placeholder in the table before doing any decoding. References to the
+	// wrapper should resolve to the unwrapped value, so the entry is replaced below.
+	// The wrapped value isn't known until then, so a reference to the wrapper from
+	// inside it is an error.
+	index := len(cxt.objectTable)
+	cxt.storeObjectInTable(unfinishedValue{})
+
+	result := cxt.ReadValueAmf3()
+	if cxt.errored() {
+		return nil
+	}
+	cxt.objectTable[index] = result
+	return result
+}
+
+// Write a Go slice or array as an ArrayCollection. The type marker should already
+// be written.
+func (cxt *Encoder) writeArrayCollectionAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	// writeClassDefinitionAmf3 will also write the ref section.
+	cxt.writeClassDefinitionAmf3(arrayCollectionClass)
+
+	// The source array is only ever referenced through the ArrayCollection, so it
+	// takes an object index but isn't entered in the table.
+	cxt.writeByte(amf3_arrayType)
+	cxt.objectCount++
+	return cxt.writeArrayElementsAmf3(value)
+}
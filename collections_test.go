@@ -0,0 +1,37 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+const arrayCollectionHex = "0a0743666c65782e6d6573736167696e672e696f2e4172726179436f6c6c656374696f6e"
+const objectProxyHex = "0a073b666c65782e6d6573736167696e672e696f2e4f626a65637450726f7879"
+
+func TestReadCollections(t *testing.T) {
+	testReadAmf3(t, arrayCollectionHex+"090701040104020403", "[1 2 3]")
+	testReadAmf3(t, objectProxyHex+"0a0b010361040101", "map[a:1]")
+
+	// A reference to the ArrayCollection resolves to the unwrapped array
+	testReadAmf3(t, "090501"+arrayCollectionHex+"09030104010a02", "[[1] [1]]")
+
+	// An ObjectProxy whose object refers back to the proxy can't be unwrapped
+	expectReadErrorAmf3(t, objectProxyHex+"0a0b010973656c660a0001")
+}
+
+func TestWriteArrayCollection(t *testing.T) {
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.UseArrayCollection = true
+
+	shared := []int{1}
+	encoder.WriteValueAmf3(map[int][]int{0: shared})
+	encoder.WriteValueAmf3(shared)
+
+	// The second write is a reference to the ArrayCollection (index 1).
+	expected := "1103000400" + arrayCollectionHex + "0903010401" + "0a02"
+	if hex.EncodeToString(writer.Bytes()) != expected {
+		t.Errorf("Wrong ArrayCollection encoding: %x", writer.Bytes())
+	}
+}
@@ -0,0 +1,116 @@
+package amf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The error reported by a Decoder when the stream can't be decoded.
+type DecodeError struct {
+	// Number of bytes read from the stream when the error happened.
+	Offset int64
+
+	// Type marker of the innermost value being read, or -1 if no value had
+	// been started.
+	Marker int
+
+	// Location of that value in the decoded data, such as
+	// "messages[0].body[0].headers.DSId". Empty at the top level.
+	Path string
+
+	// The underlying problem.
+	Err os.Error
+}
+
+func (err *DecodeError) String() string {
+	path := err.Path
+	if path == "" {
+		path = "(top level)"
+	}
+	return fmt.Sprintf("amf: %v at offset %d (type marker %d, path %s)",
+		err.Err, err.Offset, err.Marker, path)
+}
+
+// Counts the bytes read from a stream, so that a DecodeError can report where it
+// happened, and stops at the decoder's MaxBytes limit.
+type countingReader struct {
+	stream Reader
+	count  int64
+	limits *DecodeLimits
+}
+
+func (r *countingReader) Read(p []byte) (n int, err os.Error) {
+	if max := r.limits.MaxBytes; max > 0 {
+		remaining := max - r.count
+		if remaining <= 0 {
+			return 0, os.NewError(fmt.Sprintf("Stream exceeds limit of %d bytes", max))
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err = r.stream.Read(p)
+	r.count += int64(n)
+	return
+}
+
+// One step of a Decoder's path: either a named property or an index into a list.
+// Indexes are only formatted when an error is reported.
+type pathElement struct {
+	name  string
+	index int
+}
+
+func (cxt *Decoder) pushPathName(name string) {
+	cxt.path = append(cxt.path, pathElement{name: name, index: -1})
+}
+func (cxt *Decoder) pushPathIndex(index int) {
+	cxt.path = append(cxt.path, pathElement{index: index})
+}
+func (cxt *Decoder) popPath() {
+	cxt.path = cxt.path[:len(cxt.path)-1]
+}
+
+func (cxt *Decoder) currentPath() string {
+	parts := make([]string, len(cxt.path))
+	for i, element := range cxt.path {
+		if element.index < 0 {
+			parts[i] = "." + element.name
+		} else {
+			parts[i] = fmt.Sprintf("[%d]", element.index)
+		}
+	}
+	return strings.TrimLeft(strings.Join(parts, ""), ".")
+}
+
+// Wrap err with the decoder's current position, unless it already has one.
+func (cxt *Decoder) decodeErrorAt(err os.Error) os.Error {
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+	result := &DecodeError{Marker: -1, Path: cxt.currentPath(), Err: err}
+	if counter, ok := cxt.stream.(*countingReader); ok {
+		result.Offset = counter.count
+	}
+	if len(cxt.markers) > 0 {
+		result.Marker = int(cxt.markers[len(cxt.markers)-1])
+	}
+	return result
+}
+
+// Read a property value, recording its name in the path.
+func (cxt *Decoder) readNamedAmf3(name string) interface{} {
+	cxt.pushPathName(name)
+	value := cxt.ReadValueAmf3()
+	cxt.popPath()
+	return value
+}
+
+// Read a list element, recording its index in the path.
+func (cxt *Decoder) readIndexedAmf3(index int) interface{} {
+	cxt.pushPathIndex(index)
+	value := cxt.ReadValueAmf3()
+	cxt.popPath()
+	return value
+}
@@ -0,0 +1,126 @@
+package amf
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"utf8"
+)
+
+/*
+   Go struct fields are mapped to AMF properties by name. The name can be set with a
+   struct tag, such as:
+
+     FirstName string `amf:"firstName"`
+     Notes     string `amf:"notes,omitempty"`
+     Cache     []byte `amf:"-"`
+
+   A field tagged with "-" is never written or read. Fields with "omitempty" aren't
+   written when they hold a zero value. Since every instance of a class shares the
+   same trait, these fields are sent as dynamic properties. Registered types (see
+   Registry) may be sealed ActionScript classes, which can't take dynamic
+   properties, so their omitempty fields are written as sealed properties, even
+   when empty.
+
+   Fields without a name in the tag are named by the NamingStrategy of the Encoder or
+   Decoder. If there is no strategy, the Go field name is used unchanged.
+*/
+
+// Returns the AMF property name for a Go struct field name.
+type NamingStrategy func(fieldName string) string
+
+// Lower-cases the first letter of the field name, so FirstName becomes firstName.
+func LowerCamelCase(fieldName string) string {
+	if fieldName == "" {
+		return ""
+	}
+	first, size := utf8.DecodeRuneInString(fieldName)
+	return string(unicode.ToLower(first)) + fieldName[size:]
+}
+
+type structField struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+// Returns the fields of this struct type that are mapped to AMF properties: every
+// exported field that isn't tagged with "-".
+func structFields(structType reflect.Type, naming NamingStrategy) []structField {
+	fields := make([]structField, 0, structType.NumField())
+
+	for i := 0; i < structType.NumField(); i++ {
+		goField := structType.Field(i)
+
+		// Skip unexported fields
+		if goField.PkgPath != "" {
+			continue
+		}
+
+		tag := goField.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+
+		field := structField{i, goField.Name, false}
+		if naming != nil {
+			field.name = naming(goField.Name)
+		}
+
+		options := strings.Split(tag, ",")
+		if options[0] != "" {
+			field.name = options[0]
+		}
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// Finds the struct field for an incoming property name. As well as the mapped
+// names, this accepts the property name with its first letter upper-cased, which
+// is the Go field name for the usual ActionScript naming.
+func findStructField(fields []structField, structType reflect.Type, name string) (int, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field.index, true
+		}
+	}
+
+	if name == "" {
+		return 0, false
+	}
+
+	first, size := utf8.DecodeRuneInString(name)
+	goName := string(unicode.ToUpper(first)) + name[size:]
+	for _, field := range fields {
+		if structType.Field(field.index).Name == goName {
+			return field.index, true
+		}
+	}
+	return 0, false
+}
+
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return value.IsNil()
+	}
+	return false
+}
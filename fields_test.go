@@ -0,0 +1,71 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+type Person struct {
+	FirstName string `amf:"first"`
+	LastName  string
+	Age       int    `amf:",omitempty"`
+	Secret    string `amf:"-"`
+	internal  int
+}
+
+func TestStructTags(t *testing.T) {
+	const header = "0a2b0d506572736f6e0b6669727374116c6173744e616d65"
+	tests := []struct {
+		person Person
+		blob   string
+	}{
+		{Person{"A", "B", 0, "x", 1}, header + "06034106034201"},
+		{Person{"A", "B", 5, "x", 1}, header + "06034106034207616765040501"},
+	}
+
+	for _, test := range tests {
+		writer := bytes.NewBuffer(make([]byte, 0))
+		encoder := NewEncoder(writer)
+		encoder.FieldNaming = LowerCamelCase
+		encoder.WriteValueAmf3(test.person)
+
+		if hex.EncodeToString(writer.Bytes()) != test.blob {
+			t.Errorf("Wrong encoding for %v: %x", test.person, writer.Bytes())
+		}
+
+		decoder := NewDecoder(writer, 3)
+		decoder.FieldNaming = LowerCamelCase
+		decoder.RegisterType("Person", Person{})
+		value := decoder.ReadValueAmf3()
+
+		expected := test.person
+		expected.Secret = ""
+		expected.internal = 0
+		if person, ok := value.(Person); !ok || person != expected {
+			t.Errorf("Wrong decoded value: %v, err = %v", value, decoder.decodeError)
+		}
+	}
+}
+
+func TestOmitEmptyRegistered(t *testing.T) {
+	// A registered class may be sealed, so omitempty fields are still sealed
+	// properties, written even when empty.
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.FieldNaming = LowerCamelCase
+	encoder.RegisterType("com.acme.Person", Person{})
+	encoder.WriteValueAmf3(Person{"A", "B", 0, "x", 1})
+
+	const blob = "0a331f636f6d2e61636d652e506572736f6e0b6669727374116c6173744e616d65" +
+		"076167650603410603420400"
+	if hex.EncodeToString(writer.Bytes()) != blob {
+		t.Errorf("Wrong encoding for registered type: %x", writer.Bytes())
+	}
+}
+
+func TestLowerCamelCase(t *testing.T) {
+	if LowerCamelCase("FirstName") != "firstName" || LowerCamelCase("") != "" {
+		t.Error("Wrong result from LowerCamelCase")
+	}
+}
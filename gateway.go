@@ -22,17 +22,57 @@ func writeReply500(w http.ResponseWriter) {
 		"Unexplained error")
 }
 
+// A Flex remoting gateway, which can be used as an http.Handler.
+type Gateway struct {
+	// Class aliases used for requests and replies. If nil, DefaultRegistry is used.
+	Registry *Registry
+
+	// Receives diagnostic output from the gateway, and from the Decoder and Encoder
+	// that it uses. If nil, nothing is printed.
+	Logger Logger
+
+	// Bounds on incoming requests. If nil, DefaultDecodeLimits is used.
+	Limits *DecodeLimits
+}
+
+func (gateway *Gateway) logf(format string, v ...interface{}) {
+	if gateway.Logger != nil {
+		gateway.Logger.Printf(format, v...)
+	}
+}
+
+var defaultGateway = &Gateway{}
+
 func HttpHandler(w http.ResponseWriter, r *http.Request) {
+	defaultGateway.ServeHTTP(w, r)
+}
+
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "Get" {
 		handleGet(w)
 		return
 	}
 
-	requestBundle, _ := DecodeMessageBundle(r.Body)
+	decoder := NewDecoder(r.Body, 0)
+	decoder.Logger = gateway.Logger
+	decoder.Limits = DefaultDecodeLimits
+	if gateway.Limits != nil {
+		decoder.Limits = *gateway.Limits
+	}
+	if gateway.Registry != nil {
+		decoder.Registry = gateway.Registry
+	}
 
-	// Initialize the reply bundle.
+	requestBundle, err := ReadMessageBundle(decoder)
+	if err != nil {
+		gateway.logf("failed to decode request: %v", err)
+		writeReply500(w)
+		return
+	}
+
+	// Initialize the reply bundle, using the same AMF version as the request.
 	replyBundle := MessageBundle{}
-	replyBundle.AmfVersion = 3
+	replyBundle.AmfVersion = requestBundle.AmfVersion
 	replyBundle.Messages = make([]AmfMessage, len(requestBundle.Messages))
 
 	// Construct a reply to each message.
@@ -62,13 +102,21 @@ func HttpHandler(w http.ResponseWriter, r *http.Request) {
 			reply.TargetUri = request.TargetUri + "/onStatus"
 		}
 		reply.ResponseUri = ""
-		fmt.Printf("writing reply to message %d, targetUri = %s", index, reply.TargetUri)
+		gateway.logf("writing reply to message %d, targetUri = %s", index, reply.TargetUri)
 	}
 
 	// Encode the outgoing message bundle.
 	replyBuffer := bytes.NewBuffer(make([]byte, 0))
 	encoder := NewEncoder(replyBuffer)
-	EncodeMessageBundle(encoder, &replyBundle)
+	encoder.Logger = gateway.Logger
+	if gateway.Registry != nil {
+		encoder.Registry = gateway.Registry
+	}
+	if err := EncodeMessageBundle(encoder, &replyBundle); err != nil {
+		gateway.logf("failed to encode reply: %v", err)
+		writeReply500(w)
+		return
+	}
 	replyBytes := replyBuffer.Bytes()
 	w.Write(replyBytes)
 
@@ -76,7 +124,7 @@ func HttpHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Length", strconv.Itoa(len(replyBytes)))
 	w.Header().Set("Server", "SERVER_NAME")
 
-	fmt.Printf("writing reply data with length: %d", len(replyBytes))
+	gateway.logf("writing reply data with length: %d", len(replyBytes))
 }
 
 func amfMessageHandler(request AmfMessage) (data interface{}, success bool) {
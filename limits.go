@@ -0,0 +1,99 @@
+package amf
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Bounds on what a Decoder will accept, so that a hostile stream can't exhaust
+// memory or the stack. A zero field means no limit.
+type DecodeLimits struct {
+	// Longest string, XML value or ByteArray, in bytes.
+	MaxStringLength int
+
+	// Most elements in an array, vector or dictionary, and most properties in an
+	// object.
+	MaxCollectionSize int
+
+	// Deepest nesting of values.
+	MaxDepth int
+
+	// Most entries in each of the object, string and class reference tables.
+	MaxReferences int
+
+	// Most bytes read from the stream.
+	MaxBytes int64
+}
+
+// The limits used by Gateway, Unmarshal, UnmarshalAmf0, ReadValueAmf3 and
+// DecodeMessageBundle. They're generous for ordinary Flex traffic.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxStringLength:   16 << 20,
+	MaxCollectionSize: 1 << 20,
+	MaxDepth:          128,
+	MaxReferences:     1 << 20,
+	MaxBytes:          64 << 20,
+}
+
+// Save an error and return false if n is over limit.
+func (cxt *Decoder) checkLimit(what string, n int, limit int) bool {
+	if limit > 0 && n > limit {
+		cxt.saveError(os.NewError(fmt.Sprintf("%s %d exceeds limit of %d", what, n, limit)))
+		return false
+	}
+	return true
+}
+
+func (cxt *Decoder) checkStringLength(length int) bool {
+	return cxt.checkLimit("String length", length, cxt.Limits.MaxStringLength)
+}
+
+func (cxt *Decoder) checkCollectionSize(size int) bool {
+	return cxt.checkLimit("Collection size", size, cxt.Limits.MaxCollectionSize)
+}
+
+// Check that a reference table with the given number of entries can take one more.
+func (cxt *Decoder) checkReferences(tableSize int) bool {
+	return cxt.checkLimit("Reference table size", tableSize+1, cxt.Limits.MaxReferences)
+}
+
+// Collections are allocated for at most this many elements before they're read,
+// and grow as elements arrive, so that a count larger than the data can't allocate
+// memory that the stream doesn't hold.
+const maxPreallocated = 1024
+
+// The capacity to allocate for a collection with this declared size.
+func preallocated(count int) int {
+	if count > maxPreallocated {
+		return maxPreallocated
+	}
+	return count
+}
+
+const readChunkSize = 64 * 1024
+
+// Read length bytes. Long reads are done in chunks, so that a length prefix larger
+// than the stream can't allocate more memory than the stream really holds.
+func (cxt *Decoder) readFull(length int) ([]byte, os.Error) {
+	if length <= readChunkSize {
+		data := make([]byte, length)
+		n, err := io.ReadFull(cxt.stream, data)
+		return data[:n], err
+	}
+
+	data := make([]byte, 0, readChunkSize)
+	for len(data) < length {
+		start := len(data)
+		chunk := length - start
+		if chunk > readChunkSize {
+			chunk = readChunkSize
+		}
+		data = append(data, make([]byte, chunk)...)
+		n, err := io.ReadFull(cxt.stream, data[start:])
+		if err != nil {
+			return data[:start+n], err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,85 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func readWithLimits(blobStr string, limits DecodeLimits) (interface{}, os.Error) {
+	blob, _ := hex.DecodeString(blobStr)
+	decoder := NewDecoder(bytes.NewBuffer(blob), 3)
+	decoder.Limits = limits
+	value := decoder.ReadValueAmf3()
+	return value, decoder.decodeError
+}
+
+func testLimit(t *testing.T, blobStr string, within DecodeLimits, over DecodeLimits) {
+	if _, err := readWithLimits(blobStr, within); err != nil {
+		t.Errorf("Unexpected error for %s with limits %+v: %v", blobStr, within, err)
+	}
+	if _, err := readWithLimits(blobStr, over); err == nil {
+		t.Errorf("Expected error for %s with limits %+v", blobStr, over)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	// "hello"
+	testLimit(t, "060b68656c6c6f", DecodeLimits{MaxStringLength: 5}, DecodeLimits{MaxStringLength: 4})
+	testLimit(t, "060b68656c6c6f", DecodeLimits{MaxBytes: 7}, DecodeLimits{MaxBytes: 6})
+
+	// [1, 2, 3]
+	testLimit(t, "090701040104020403", DecodeLimits{MaxCollectionSize: 3},
+		DecodeLimits{MaxCollectionSize: 2})
+
+	// {a: 1, b: 2}
+	testLimit(t, "0a0b01036104010362040201", DecodeLimits{MaxCollectionSize: 2},
+		DecodeLimits{MaxCollectionSize: 1})
+
+	// [[[]]]
+	testLimit(t, "090301090301090101", DecodeLimits{MaxDepth: 3}, DecodeLimits{MaxDepth: 2})
+
+	// ["a", "b", "c"]
+	testLimit(t, "090701060361060362060363", DecodeLimits{MaxReferences: 3},
+		DecodeLimits{MaxReferences: 2})
+}
+
+func TestLongLengthWithoutData(t *testing.T) {
+	// A string that claims to be over 100MB long, with no data following.
+	_, err := readWithLimits("06bfffffff", DecodeLimits{})
+	if err == nil {
+		t.Errorf("Expected error for truncated string")
+	}
+
+	// A ByteArray of the same length.
+	_, err = readWithLimits("0cbfffffff", DecodeLimits{})
+	if err == nil {
+		t.Errorf("Expected error for truncated byte array")
+	}
+}
+
+func TestLargeCountsWithoutData(t *testing.T) {
+	// Nested arrays that each claim 1<<20 elements, with nothing following. The
+	// elements are read before any space is reserved for them, so this fails
+	// without allocating for the declared counts.
+	blobStr := ""
+	for i := 0; i < 100; i++ {
+		blobStr += "0980c0800101"
+	}
+	blob, _ := hex.DecodeString(blobStr)
+	var result interface{}
+	if err := Unmarshal(blob, &result); err == nil {
+		t.Errorf("Expected error for truncated arrays")
+	}
+
+	// The same in AMF0, as strict arrays.
+	blobStr = ""
+	for i := 0; i < 100; i++ {
+		blobStr += "0a00100000"
+	}
+	blob, _ = hex.DecodeString(blobStr)
+	if err := UnmarshalAmf0(blob, &result); err == nil {
+		t.Errorf("Expected error for truncated strict arrays")
+	}
+}
@@ -0,0 +1,400 @@
+package amf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+)
+
+/*
+   Marshal and Unmarshal work like their counterparts in the json package.
+   Unmarshal decodes values as usual, and then stores them into the destination
+   using these rules:
+
+     - Numbers can be stored in any Go numeric type, if they fit.
+     - Arrays, Vectors and ArrayCollections can be stored in slices and arrays.
+     - Objects (anonymous, typed, or ObjectProxy) can be stored in structs or
+       string-keyed maps. Struct fields are matched as described in fields.go.
+     - Dictionaries can be stored in maps with any key type.
+     - Anything can be stored in an interface{}.
+     - Types that implement Unmarshaler are passed the decoded value. Otherwise,
+       types that implement TextUnmarshaler are passed decoded strings.
+     - Pointers are allocated as needed. Objects that are referenced more than once
+       are stored in a single pointer, so cyclic structures can be decoded.
+*/
+
+// Implemented by types that are written as another value. MarshalAMF returns the
+// value to write in place of the receiver.
+type Marshaler interface {
+	MarshalAMF() (interface{}, os.Error)
+}
+
+// Implemented by types that populate themselves from a decoded value. The value is
+// in the form returned by ReadValueAmf3.
+type Unmarshaler interface {
+	UnmarshalAMF(value interface{}) os.Error
+}
+
+// Implemented by types that have a text form. Values of these types are written as
+// strings, unless they have another AMF form.
+type TextMarshaler interface {
+	MarshalText() (text []byte, err os.Error)
+}
+
+// Implemented by types that can be read from their text form. They can be stored
+// from decoded strings.
+type TextUnmarshaler interface {
+	UnmarshalText(text []byte) os.Error
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*TextMarshaler)(nil)).Elem()
+
+// If value implements this interface, either directly or through a pointer (when
+// value is addressable), returns the implementation.
+func implementation(value reflect.Value, interfaceType reflect.Type) (interface{}, bool) {
+	if value.Type().Implements(interfaceType) && value.CanInterface() {
+		return value.Interface(), true
+	}
+	if value.CanAddr() && reflect.PtrTo(value.Type()).Implements(interfaceType) {
+		return value.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// Returns the AMF3 encoding of v.
+func Marshal(v interface{}) ([]byte, os.Error) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	err := NewEncoder(buffer).WriteValueAmf3(v)
+	return buffer.Bytes(), err
+}
+
+// Returns an AMF0 encoding of v.
+func MarshalAmf0(v interface{}) ([]byte, os.Error) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	err := NewEncoder(buffer).WriteValueAmf0(v)
+	return buffer.Bytes(), err
+}
+
+// Decode an AMF3 value and store it in the value pointed to by v. The data is
+// checked against DefaultDecodeLimits.
+func Unmarshal(data []byte, v interface{}) os.Error {
+	decoder := NewDecoder(bytes.NewBuffer(data), 3)
+	decoder.Limits = DefaultDecodeLimits
+	return decoder.Decode(v)
+}
+
+// Decode an AMF0 value and store it in the value pointed to by v. The data is
+// checked against DefaultDecodeLimits.
+func UnmarshalAmf0(data []byte, v interface{}) os.Error {
+	decoder := NewDecoder(bytes.NewBuffer(data), 0)
+	decoder.Limits = DefaultDecodeLimits
+	return decoder.Decode(v)
+}
+
+// Read the next value (using AmfVersion) and store it in the value pointed to by v.
+func (cxt *Decoder) Decode(v interface{}) os.Error {
+	destination := reflect.ValueOf(v)
+	if destination.Kind() != reflect.Ptr || destination.IsNil() {
+		return os.NewError("Decode requires a non-nil pointer")
+	}
+
+	value := cxt.ReadValue()
+
+	if cxt.errored() {
+		return cxt.decodeError
+	}
+
+	cxt.saveError(cxt.assignValue(destination.Elem(), value))
+	return cxt.decodeError
+}
+
+func assignError(value interface{}, destination reflect.Value) os.Error {
+	return os.NewError(fmt.Sprintf("Can't store a value of type %T in a %v", value,
+		destination.Type()))
+}
+
+// Store a decoded value in destination, converting it to the destination's type.
+func (cxt *Decoder) assignValue(destination reflect.Value, value interface{}) os.Error {
+	if value == nil {
+		destination.Set(reflect.Zero(destination.Type()))
+		return nil
+	}
+
+	// Types that unmarshal themselves do so even when the value could be stored
+	// in them as is.
+	if destination.Kind() != reflect.Ptr && destination.CanAddr() {
+		pointer := destination.Addr().Interface()
+		if unmarshaler, ok := pointer.(Unmarshaler); ok {
+			return unmarshaler.UnmarshalAMF(value)
+		}
+		if textUnmarshaler, ok := pointer.(TextUnmarshaler); ok {
+			if str, isString := value.(string); isString {
+				return textUnmarshaler.UnmarshalText([]byte(str))
+			}
+		}
+	}
+
+	source := reflect.ValueOf(value)
+
+	if source.Type().AssignableTo(destination.Type()) {
+		destination.Set(source)
+		return nil
+	}
+
+	// Dates are decoded as *time.Time, and can be stored in a time.Time.
+	if source.Kind() == reflect.Ptr && !source.IsNil() &&
+		source.Elem().Type().AssignableTo(destination.Type()) {
+		destination.Set(source.Elem())
+		return nil
+	}
+
+	// A value that contains itself can only be stored through a pointer. Storing it
+	// in a value of the same type while that's still being filled in would never
+	// finish.
+	if key, hasIdentity := identityKey(source); hasIdentity &&
+		destination.Kind() != reflect.Ptr {
+
+		key.typ = destination.Type()
+		if cxt.assigningValues[key] {
+			return os.NewError(fmt.Sprintf("Can't store a value that contains itself "+
+				"in a %v", destination.Type()))
+		}
+		if cxt.assigningValues == nil {
+			cxt.assigningValues = make(map[objectKey]bool)
+		}
+		cxt.assigningValues[key] = true
+		defer func() { cxt.assigningValues[key] = false }()
+	}
+
+	switch destination.Kind() {
+	case reflect.Ptr:
+		return cxt.assignPointer(destination, source)
+	case reflect.Bool:
+		if source.Kind() == reflect.Bool {
+			destination.SetBool(source.Bool())
+			return nil
+		}
+	case reflect.String:
+		if source.Kind() == reflect.String {
+			destination.SetString(source.String())
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if number, ok := integerValue(source); ok && !destination.OverflowInt(number) {
+			destination.SetInt(number)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := integerValue(source)
+		if ok && number >= 0 && !destination.OverflowUint(uint64(number)) {
+			destination.SetUint(uint64(number))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if number, ok := floatValue(source); ok {
+			destination.SetFloat(number)
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		return cxt.assignSequence(destination, value)
+	case reflect.Map:
+		return cxt.assignMap(destination, value)
+	case reflect.Struct:
+		return cxt.assignStruct(destination, value)
+	}
+
+	return assignError(value, destination)
+}
+
+func integerValue(source reflect.Value) (int64, bool) {
+	switch source.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return source.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if source.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(source.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		// Only whole numbers can be stored in an integer.
+		number := source.Float()
+		if number != math.Trunc(number) || math.Abs(number) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(number), true
+	}
+	return 0, false
+}
+
+func floatValue(source reflect.Value) (float64, bool) {
+	switch source.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(source.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(source.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return source.Float(), true
+	}
+	return 0, false
+}
+
+func (cxt *Decoder) assignPointer(destination reflect.Value, source reflect.Value) os.Error {
+
+	// Objects that appear more than once in the stream are decoded to the same Go
+	// pointer. This also stops us from recursing forever on cyclic values.
+	key := objectKey{}
+	hasIdentity := false
+	if source.Kind() == reflect.Ptr || source.Kind() == reflect.Map {
+		key = objectKey{destination.Type(), source.Pointer(), 0}
+		hasIdentity = true
+	}
+
+	if hasIdentity {
+		if pointer, found := cxt.assignedPointers[key]; found {
+			destination.Set(pointer)
+			return nil
+		}
+	}
+
+	pointer := reflect.New(destination.Type().Elem())
+	if hasIdentity {
+		if cxt.assignedPointers == nil {
+			cxt.assignedPointers = make(map[objectKey]reflect.Value)
+		}
+		cxt.assignedPointers[key] = pointer
+	}
+
+	destination.Set(pointer)
+	return cxt.assignValue(pointer.Elem(), source.Interface())
+}
+
+func (cxt *Decoder) assignSequence(destination reflect.Value, value interface{}) os.Error {
+	var source reflect.Value
+
+	switch value := value.(type) {
+	case *AvmArray:
+		source = reflect.ValueOf(value.elements)
+	case *AvmVector:
+		source = reflect.ValueOf(value.Elements)
+	case *IntVector:
+		source = reflect.ValueOf(value.Elements)
+	case *UintVector:
+		source = reflect.ValueOf(value.Elements)
+	case *DoubleVector:
+		source = reflect.ValueOf(value.Elements)
+	default:
+		source = reflect.ValueOf(value)
+		if source.Kind() != reflect.Slice && source.Kind() != reflect.Array {
+			return assignError(value, destination)
+		}
+	}
+
+	length := source.Len()
+
+	if destination.Kind() == reflect.Array {
+		if length != destination.Len() {
+			return os.NewError(fmt.Sprintf("Can't store %d elements in a %v", length,
+				destination.Type()))
+		}
+	} else {
+		destination.Set(reflect.MakeSlice(destination.Type(), length, length))
+	}
+
+	for i := 0; i < length; i++ {
+		err := cxt.assignValue(destination.Index(i), source.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls visit for each named field of an object. Returns false if value isn't an
+// object.
+func eachObjectField(value interface{},
+	visit func(name string, value interface{}) os.Error) (bool, os.Error) {
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range value {
+			if err := visit(name, fieldValue); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	case *AvmObject:
+		for i, name := range value.class.properties {
+			if err := visit(name, value.staticFields[i]); err != nil {
+				return true, err
+			}
+		}
+		for name, fieldValue := range value.dynamicFields {
+			if err := visit(name, fieldValue); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	case *AvmArray:
+		for name, fieldValue := range value.fields {
+			if err := visit(name, fieldValue); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (cxt *Decoder) assignMap(destination reflect.Value, value interface{}) os.Error {
+	mapType := destination.Type()
+	destination.Set(reflect.MakeMap(mapType))
+
+	assignEntry := func(key interface{}, entryValue interface{}) os.Error {
+		reflectedKey := reflect.New(mapType.Key()).Elem()
+		if err := cxt.assignValue(reflectedKey, key); err != nil {
+			return err
+		}
+		reflectedValue := reflect.New(mapType.Elem()).Elem()
+		if err := cxt.assignValue(reflectedValue, entryValue); err != nil {
+			return err
+		}
+		destination.SetMapIndex(reflectedKey, reflectedValue)
+		return nil
+	}
+
+	if dictionary, ok := value.(*AvmDictionary); ok {
+		for _, entry := range dictionary.Entries {
+			if err := assignEntry(entry.Key, entry.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	isObject, err := eachObjectField(value, func(name string, fieldValue interface{}) os.Error {
+		return assignEntry(name, fieldValue)
+	})
+	if !isObject {
+		return assignError(value, destination)
+	}
+	return err
+}
+
+func (cxt *Decoder) assignStruct(destination reflect.Value, value interface{}) os.Error {
+	fields := structFields(destination.Type(), cxt.FieldNaming)
+
+	isObject, err := eachObjectField(value, func(name string, fieldValue interface{}) os.Error {
+		index, found := findStructField(fields, destination.Type(), name)
+		if !found {
+			return nil
+		}
+		return cxt.assignValue(destination.Field(index), fieldValue)
+	})
+	if !isObject {
+		return assignError(value, destination)
+	}
+	return err
+}
@@ -0,0 +1,284 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Order struct {
+	Id       int
+	Customer *Customer
+	Lines    []OrderLine
+	Tags     map[string]string
+}
+
+type OrderLine struct {
+	Product  string
+	Quantity uint16
+	Price    float32
+}
+
+type TreeNode struct {
+	Name     string
+	Parent   *TreeNode
+	Children []*TreeNode
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	order := Order{7, &Customer{"Sam"},
+		[]OrderLine{{"apple", 3, 0.5}, {"pear", 1, 0.25}},
+		map[string]string{"rush": "yes"}}
+
+	data, err := Marshal(order)
+	if err != nil {
+		t.Errorf("Marshal returned error: %v", err)
+	}
+
+	var result Order
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Errorf("Unmarshal returned error: %v", err)
+	}
+	if !reflect.DeepEqual(order, result) {
+		t.Errorf("Unmarshal result %v didn't match %v", result, order)
+	}
+
+	// AMF0 (switching to AMF3 for the value)
+	data, _ = MarshalAmf0(order)
+	result = Order{}
+	err = UnmarshalAmf0(data, &result)
+	if err != nil || !reflect.DeepEqual(order, result) {
+		t.Errorf("AMF0 round trip failed, result = %v, err = %v", result, err)
+	}
+}
+
+func TestUnmarshalCycles(t *testing.T) {
+	root := &TreeNode{Name: "root"}
+	child := &TreeNode{Name: "child", Parent: root}
+	root.Children = []*TreeNode{child}
+
+	data, _ := Marshal(root)
+
+	var result *TreeNode
+	err := Unmarshal(data, &result)
+	if err != nil {
+		t.Errorf("Unmarshal returned error: %v", err)
+		return
+	}
+	if len(result.Children) != 1 || result.Children[0].Parent != result {
+		t.Errorf("Cyclic structure wasn't restored: %v", result)
+	}
+}
+
+type LinkedNode struct {
+	Name string
+	Next *LinkedNode
+}
+
+func TestUnmarshalRegisteredCycles(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.example.TreeNode", TreeNode{})
+	registry.RegisterClassAlias("com.example.LinkedNode", LinkedNode{})
+
+	node := &LinkedNode{Name: "loop"}
+	node.Next = node
+	root := &TreeNode{Name: "root"}
+	root.Children = []*TreeNode{{Name: "child", Parent: root}}
+
+	for _, amfVersion := range []uint16{0, 3} {
+		buffer := bytes.NewBuffer(nil)
+		encoder := NewEncoder(buffer)
+		encoder.Registry = registry
+		decoder := NewDecoder(buffer, amfVersion)
+		decoder.Registry = registry
+
+		if amfVersion == 0 {
+			encoder.WriteValueAmf0(node)
+		} else {
+			encoder.WriteValueAmf3(node)
+		}
+		var nodeResult *LinkedNode
+		err := decoder.Decode(&nodeResult)
+		if err != nil || nodeResult.Name != "loop" || nodeResult.Next != nodeResult {
+			t.Errorf("AMF%d: cycle wasn't restored: %#v (err = %v)", amfVersion,
+				nodeResult, err)
+		}
+
+		if amfVersion == 0 {
+			encoder.WriteValueAmf0(root)
+		} else {
+			encoder.WriteValueAmf3(root)
+		}
+		var rootResult *TreeNode
+		err = decoder.Decode(&rootResult)
+		if err != nil || len(rootResult.Children) != 1 ||
+			rootResult.Children[0].Parent != rootResult {
+			t.Errorf("AMF%d: cycle wasn't restored: %#v (err = %v)", amfVersion,
+				rootResult, err)
+		}
+	}
+}
+
+type Tree struct {
+	Kids []Tree
+}
+
+func TestUnmarshalCyclesWithoutPointers(t *testing.T) {
+	// {Kids: [<reference to itself>]} can't be stored without a pointer.
+	data, _ := hex.DecodeString("0a0b01094b6964730903010a0001")
+	var tree Tree
+	if err := Unmarshal(data, &tree); err == nil {
+		t.Errorf("Expected an error for a cycle without pointers, got: %v", tree)
+	}
+
+	// The same, as a registered class that's unpacked while it's read.
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.example.Tree", Tree{})
+	data, _ = hex.DecodeString("0a1321636f6d2e6578616d706c652e54726565094b696473" +
+		"0903010a00")
+	decoder := NewDecoder(bytes.NewBuffer(data), 3)
+	decoder.Registry = registry
+	value := decoder.ReadValueAmf3()
+	if decoder.decodeError == nil {
+		t.Errorf("Expected an error for a registered cycle without pointers, got: %v",
+			value)
+	}
+}
+
+func TestUnmarshalConversions(t *testing.T) {
+	var numbers []int64
+	data, _ := hex.DecodeString("09070104010500000000000000000403")
+	err := Unmarshal(data, &numbers)
+	if err != nil || !reflect.DeepEqual(numbers, []int64{1, 0, 3}) {
+		t.Errorf("Wrong result: %v, err = %v", numbers, err)
+	}
+
+	// Vector.<int>
+	data, _ = hex.DecodeString("0d050000000001ffffffff")
+	err = Unmarshal(data, &numbers)
+	if err != nil || !reflect.DeepEqual(numbers, []int64{1, -1}) {
+		t.Errorf("Wrong result: %v, err = %v", numbers, err)
+	}
+	var vector IntVector
+	if err := Unmarshal(data, &vector); err != nil || len(vector.Elements) != 2 {
+		t.Errorf("Wrong result: %v, err = %v", vector, err)
+	}
+
+	var small uint8
+	data, _ = hex.DecodeString("048952")
+	if err := Unmarshal(data, &small); err == nil {
+		t.Errorf("Expected an overflow error, result = %d", small)
+	}
+
+	var dictionary map[int]string
+	data, _ = hex.DecodeString("110301040106076f6e65")
+	if err := Unmarshal(data, &dictionary); err != nil || dictionary[1] != "one" {
+		t.Errorf("Wrong result: %v, err = %v", dictionary, err)
+	}
+
+	var anything interface{}
+	data, _ = hex.DecodeString("060361")
+	if err := Unmarshal(data, &anything); err != nil || anything != "a" {
+		t.Errorf("Wrong result: %v, err = %v", anything, err)
+	}
+
+	if err := Unmarshal(data, anything); err == nil {
+		t.Error("Expected an error for a non-pointer destination")
+	}
+}
+
+// An amount in cents, sent to Flash as a Number of dollars.
+type Money int64
+
+func (m Money) MarshalAMF() (interface{}, os.Error) {
+	return float64(m) / 100, nil
+}
+
+func (m *Money) UnmarshalAMF(value interface{}) os.Error {
+	dollars, ok := value.(float64)
+	if !ok {
+		return os.NewError("Money must be a Number")
+	}
+	*m = Money(dollars*100 + 0.5)
+	return nil
+}
+
+type Color int
+
+var colorNames = []string{"red", "green"}
+
+func (c Color) MarshalText() ([]byte, os.Error) {
+	return []byte(colorNames[c]), nil
+}
+
+func (c *Color) UnmarshalText(text []byte) os.Error {
+	for i, name := range colorNames {
+		if name == string(text) {
+			*c = Color(i)
+			return nil
+		}
+	}
+	return os.NewError("Unknown color: " + string(text))
+}
+
+// Attributes, with their names in lower case.
+type Attrs map[string]interface{}
+
+func (a *Attrs) UnmarshalAMF(value interface{}) os.Error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return os.NewError("Attrs must be an object")
+	}
+	*a = make(Attrs)
+	for name, field := range fields {
+		(*a)[strings.ToLower(name)] = field
+	}
+	return nil
+}
+
+type Product struct {
+	Price Money
+	Color Color
+}
+
+func TestCustomMarshalers(t *testing.T) {
+	testWriteAmf3(t, Money(250), "054004000000000000")
+	testWriteAmf3(t, Color(1), "060b677265656e")
+
+	product := Product{1999, 1}
+	data, err := Marshal(&product)
+	if err != nil {
+		t.Errorf("Marshal returned error: %v", err)
+	}
+
+	var result Product
+	err = Unmarshal(data, &result)
+	if err != nil || result != product {
+		t.Errorf("Wrong result: %v, err = %v", result, err)
+	}
+
+	var color Color
+	data, _ = hex.DecodeString("060b626c7565")
+	if err := Unmarshal(data, &color); err == nil {
+		t.Error("Expected an error from UnmarshalText")
+	}
+
+	// Unmarshalers are used even if the decoded value could be stored directly.
+	var attrs Attrs
+	data, _ = Marshal(map[string]interface{}{"Name": "a"})
+	if err := Unmarshal(data, &attrs); err != nil || len(attrs) != 1 || attrs["name"] != "a" {
+		t.Errorf("Wrong result: %v, err = %v", attrs, err)
+	}
+
+	// Types with their own AMF form are written that way, even through a pointer,
+	// before looking for a TextMarshaler.
+	testWriteAmf3(t, &time.Time{Year: 1970, Month: 1, Day: 1, Zone: "UTC"},
+		"08010000000000000000")
+	testWriteAmf0(t, nil, &time.Time{Year: 1970, Month: 1, Day: 1, Zone: "UTC"},
+		"0b00000000000000000000")
+}
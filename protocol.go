@@ -3,9 +3,13 @@ package amf
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
+	"xml"
 )
 
 type Reader interface {
@@ -16,12 +20,33 @@ type Writer interface {
 	Write(p []byte) (n int, err os.Error)
 }
 
+// Receives diagnostic output from a Decoder, Encoder or Gateway. A *log.Logger can
+// be used. Without a Logger, nothing is printed.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 type AvmObject struct {
 	class         *AvmClass
 	staticFields  []interface{}
 	dynamicFields map[string]interface{}
 }
 
+func (object *AvmObject) ClassName() string {
+	return object.class.name
+}
+
+// Returns the value of a sealed or dynamic field.
+func (object *AvmObject) Get(name string) (interface{}, bool) {
+	for i, property := range object.class.properties {
+		if property == name {
+			return object.staticFields[i], true
+		}
+	}
+	value, found := object.dynamicFields[name]
+	return value, found
+}
+
 type AvmClass struct {
 	name           string
 	externalizable bool
@@ -36,20 +61,98 @@ type AvmArray struct {
 	fields   map[string]interface{}
 }
 
+func (array *AvmArray) Elements() []interface{} {
+	return array.elements
+}
+
+func (array *AvmArray) Fields() map[string]interface{} {
+	return array.fields
+}
+
+// Implemented by Go types that correspond to an IExternalizable ActionScript class.
+// These types must be registered (see Registry) under the class alias.
+// ReadExternal and WriteExternal are called with the Decoder and Encoder, and must
+// use the same byte layout as the ActionScript readExternal and writeExternal
+// methods. Decoded values are pointers to the registered type.
+type Externalizable interface {
+	ReadExternal(cxt *Decoder) os.Error
+	WriteExternal(cxt *Encoder) os.Error
+}
+
+// A Vector.<T> of objects. TypeName is the class name of the elements ("*" for
+// an untyped Vector), and Fixed is the Vector's fixed-length flag. Vectors of a
+// class that was registered with a slice (see Registry) are decoded into that
+// slice type instead. The slice doesn't keep the fixed flag, and like any slice
+// it's written as an Array.
+type AvmVector struct {
+	TypeName string
+	Fixed    bool
+	Elements []interface{}
+}
+
+// A Vector.<int>. Go slices are written as Arrays, so use this type (or UintVector
+// or DoubleVector) to send a Vector.
+type IntVector struct {
+	Fixed    bool
+	Elements []int32
+}
+
+// A Vector.<uint>.
+type UintVector struct {
+	Fixed    bool
+	Elements []uint32
+}
+
+// A Vector.<Number>.
+type DoubleVector struct {
+	Fixed    bool
+	Elements []float64
+}
+
+// A flash.utils.Dictionary. Keys can be any value (including objects), so the
+// entries are kept as a list of pairs instead of a Go map.
+type AvmDictionary struct {
+	WeakKeys bool
+	Entries  []AvmDictionaryEntry
+}
+
+type AvmDictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// An E4X XML value (the AS3 "XML" class), stored as its source text.
+type XML string
+
+// A legacy flash.xml.XMLDocument value, stored as its source text.
+type XMLDocument string
+
+// Written as the AS3 undefined value, where nil is written as null. Decoders
+// return nil for both.
+type Undefined struct{}
+
+// Parse the XML text into v, using the rules of xml.Unmarshal.
+func (x XML) Unmarshal(v interface{}) os.Error {
+	return xml.Unmarshal(strings.NewReader(string(x)), v)
+}
+
+// Parse the XML text into v, using the rules of xml.Unmarshal.
+func (x XMLDocument) Unmarshal(v interface{}) os.Error {
+	return xml.Unmarshal(strings.NewReader(string(x)), v)
+}
+
 // * Public functions *
 
-// Read an AMF3 value from the stream.
+// Read an AMF3 value from the stream, within DefaultDecodeLimits.
 func ReadValueAmf3(stream Reader) (interface{}, os.Error) {
-	cxt := &Decoder{}
-	cxt.AmfVersion = 3
-	cxt.stream = stream
+	cxt := NewDecoder(stream, 3)
+	cxt.Limits = DefaultDecodeLimits
 	result := cxt.ReadValueAmf3()
 	return result, cxt.decodeError
 }
 
 func WriteValueAmf3(stream Writer, value interface{}) os.Error {
-	cxt := &Encoder{}
-	cxt.stream = stream
+	cxt := NewEncoder(stream)
 	return cxt.WriteValueAmf3(value)
 }
 
@@ -74,19 +177,24 @@ const (
 	amf0_typedObjectType   = 16
 	amf0_avmPlusObjectType = 17
 
-	amf3_undefinedType  = 0
-	amf3_nullType       = 1
-	amf3_falseType      = 2
-	amf3_trueType       = 3
-	amf3_integerType    = 4
-	amf3_doubleType     = 5
-	amf3_stringType     = 6
-	amf3_xmlType        = 7
-	amf3_dateType       = 8
-	amf3_arrayType      = 9
-	amf3_objectType     = 10
-	amf3_avmPlusXmlType = 11
-	amf3_byteArrayType  = 12
+	amf3_undefinedType    = 0
+	amf3_nullType         = 1
+	amf3_falseType        = 2
+	amf3_trueType         = 3
+	amf3_integerType      = 4
+	amf3_doubleType       = 5
+	amf3_stringType       = 6
+	amf3_xmlType          = 7
+	amf3_dateType         = 8
+	amf3_arrayType        = 9
+	amf3_objectType       = 10
+	amf3_avmPlusXmlType   = 11
+	amf3_byteArrayType    = 12
+	amf3_vectorIntType    = 13
+	amf3_vectorUintType   = 14
+	amf3_vectorDoubleType = 15
+	amf3_vectorObjectType = 16
+	amf3_dictionaryType   = 17
 )
 
 type Decoder struct {
@@ -100,18 +208,51 @@ type Decoder struct {
 	classTable  []*AvmClass
 	objectTable []interface{}
 
+	// AMF0 has a single table, for objects and arrays.
+	amf0ObjectTable []interface{}
+
 	decodeError os.Error
 
-	// When unpacking objects, we'll look in this map for the type name. If found,
-	// we'll unpack the value into an instance of the associated type.
-	typeMap map[string]reflect.Type
+	// When unpacking objects, we'll look in this registry for the class name. If
+	// found, we'll unpack the value into an instance of the associated type. If nil,
+	// DefaultRegistry is used.
+	Registry *Registry
+
+	// Holds the aliases added with RegisterType.
+	localRegistry *Registry
+
+	// Names the properties of struct fields that don't have a name in their tag.
+	FieldNaming NamingStrategy
+
+	// Go pointers allocated while storing decoded values, keyed by the decoded
+	// value they were made for. See assignPointer.
+	assignedPointers map[objectKey]reflect.Value
+
+	// Decoded values that are being stored in a Go value that isn't a pointer,
+	// keyed by the destination type. See assignValue.
+	assigningValues map[objectKey]bool
+
+	// Typed objects that are still being read, innermost last. See beginObject.
+	pendingObjects []pendingObject
+
+	// Receives diagnostic output, if set.
+	Logger Logger
+
+	// Bounds on the size of the decoded data. Unlimited in a Decoder from
+	// NewDecoder, the package-level functions use DefaultDecodeLimits.
+	Limits DecodeLimits
+
+	// Where the decoder is in the value tree, and the type markers of the values
+	// currently being read. Used to describe errors.
+	path    []pathElement
+	markers []uint8
 }
 
 func NewDecoder(stream Reader, amfVersion uint16) *Decoder {
 	decoder := &Decoder{}
-	decoder.stream = stream
+	decoder.stream = &countingReader{stream: stream, limits: &decoder.Limits}
 	decoder.AmfVersion = amfVersion
-	decoder.typeMap = make(map[string]reflect.Type)
+	decoder.Registry = DefaultRegistry
 	return decoder
 }
 
@@ -123,19 +264,65 @@ func (cxt *Decoder) saveError(err os.Error) {
 		return
 	}
 	if cxt.decodeError != nil {
-		fmt.Println("warning: duplicate errors on Decoder")
+		cxt.logf("warning: duplicate errors on Decoder: %v", err)
 	} else {
-		cxt.decodeError = err
+		cxt.decodeError = cxt.decodeErrorAt(err)
+	}
+}
+func (cxt *Decoder) logf(format string, v ...interface{}) {
+	if cxt.Logger != nil {
+		cxt.Logger.Printf(format, v...)
 	}
 }
+func (cxt *Decoder) popMarker() {
+	cxt.markers = cxt.markers[:len(cxt.markers)-1]
+}
 func (cxt *Decoder) errored() bool {
 	return cxt.decodeError != nil
 }
 func (cxt *Decoder) storeObjectInTable(obj interface{}) {
+	if !cxt.checkReferences(len(cxt.objectTable)) {
+		return
+	}
 	cxt.objectTable = append(cxt.objectTable, obj)
 }
+
+// Stored in the object table for a value that can only be entered once it's fully
+// read. References to it are errors.
+type unfinishedValue struct{}
+
+// Look up an object table entry, saving an error if the reference is invalid. what
+// describes the kind of value, for the error message.
+func (cxt *Decoder) objectReference(index int, what string) interface{} {
+	if index >= len(cxt.objectTable) {
+		cxt.saveError(os.NewError(fmt.Sprintf("Invalid %s reference: %d", what, index)))
+		return nil
+	}
+	result := cxt.objectTable[index]
+	if _, unfinished := result.(unfinishedValue); unfinished {
+		cxt.saveError(os.NewError(fmt.Sprintf("Reference to %s %d while it's being read",
+			what, index)))
+		return nil
+	}
+	cxt.noteReference(result)
+	return result
+}
+func (cxt *Decoder) registry() *Registry {
+	if cxt.Registry == nil {
+		return DefaultRegistry
+	}
+	return cxt.Registry
+}
+
+// Register a class alias for this decoder only. The first call replaces Registry
+// with a private one, which still uses the aliases of the old Registry but doesn't
+// change it.
 func (cxt *Decoder) RegisterType(flexName string, instance interface{}) {
-	cxt.typeMap[flexName] = reflect.TypeOf(instance)
+	if cxt.localRegistry == nil || cxt.Registry != cxt.localRegistry {
+		cxt.localRegistry = newChildRegistry(cxt.registry())
+		cxt.Registry = cxt.localRegistry
+	}
+	cxt.localRegistry.RegisterClassAlias(flexName, instance)
 }
 
 // Helper functions.
@@ -163,6 +350,16 @@ func (cxt *Decoder) ReadUint32() uint32 {
 	cxt.saveError(err)
 	return value
 }
+func (cxt *Decoder) ReadBytes(length int) []byte {
+	data, err := cxt.readFull(length)
+	if n := len(data); n < length {
+		cxt.saveError(os.NewError(fmt.Sprintf(
+			"Not enough bytes in ReadBytes (expected %d, found %d)", length, n)))
+		return nil
+	}
+	cxt.saveError(err)
+	return data
+}
 func (cxt *Decoder) ReadFloat64() float64 {
 	var value float64
 	err := binary.Read(cxt.stream, binary.BigEndian, &value)
@@ -181,9 +378,11 @@ func (cxt *Decoder) ReadString() string {
 }
 
 func (cxt *Decoder) ReadStringKnownLength(length int) string {
-	data := make([]byte, length)
-	n, err := cxt.stream.Read(data)
-	if n < length {
+	if !cxt.checkStringLength(length) {
+		return ""
+	}
+	data, err := cxt.readFull(length)
+	if n := len(data); n < length {
 		cxt.saveError(os.NewError(fmt.Sprintf(
 			"Not enough bytes in ReadStringKnownLength (expected %d, found %d)", length, n)))
 		return ""
@@ -194,10 +393,93 @@ func (cxt *Decoder) ReadStringKnownLength(length int) string {
 
 type Encoder struct {
 	stream Writer
+
+	// Outgoing strings are sent as references once they have been written. This
+	// table maps each string to its reference index.
+	stringTable map[string]int
+
+	// Outgoing objects are tracked by identity, so that shared and cyclic values
+	// are sent as references. Every complex value takes an index (whether or not
+	// it has an identity), objectCount is the next index to hand out.
+	objectTable map[objectKey]int
+	objectCount int
+
+	// Traits (class definitions) are also sent as references after the first time.
+	// Each Go struct type is described by a single AvmClass, so that all instances
+	// share the same trait.
+	traitTable map[*AvmClass]int
+	typeTraits map[reflect.Type]*typeTrait
+
+	// Class names to write for registered Go types. If nil, DefaultRegistry is used.
+	Registry *Registry
+
+	// Holds the aliases added with RegisterType.
+	localRegistry *Registry
+
+	// Names the properties of struct fields that don't have a name in their tag.
+	FieldNaming NamingStrategy
+
+	// If set, Go slices and arrays are written as a Flex ArrayCollection instead of
+	// a plain Array.
+	UseArrayCollection bool
+
+	// If set, the keys of Go maps are written in sorted order, so that the output
+	// is deterministic.
+	SortMapKeys bool
+
+	// Integers that don't fit in 29 bits are written as doubles. If this is set,
+	// then it's an error to write an integer that a double can't hold exactly.
+	ErrorOnPrecisionLoss bool
+
+	// Receives diagnostic output, if set.
+	Logger Logger
+
+	// Outgoing AMF0 objects and arrays, which have their own reference table.
+	amf0ObjectTable map[objectKey]int
+	amf0ObjectCount int
+
+	// If set, WriteValueAmf0 writes every value other than a number, boolean,
+	// string, null or undefined as AMF3, after the avmplus type marker.
+	SwitchToAmf3 bool
+}
+
+// Identifies a Go value in the outgoing object table. Slices also need their
+// length, since two slices can share the same backing array.
+type objectKey struct {
+	typ    reflect.Type
+	ptr    uintptr
+	length int
 }
 
 func NewEncoder(stream Writer) *Encoder {
-	return &Encoder{stream}
+	encoder := &Encoder{}
+	encoder.stream = stream
+	encoder.resetTables()
+	encoder.typeTraits = make(map[reflect.Type]*typeTrait)
+	encoder.Registry = DefaultRegistry
+	return encoder
+}
+func (cxt *Encoder) logf(format string, v ...interface{}) {
+	if cxt.Logger != nil {
+		cxt.Logger.Printf(format, v...)
+	}
+}
+func (cxt *Encoder) registry() *Registry {
+	if cxt.Registry == nil {
+		return DefaultRegistry
+	}
+	return cxt.Registry
+}
+
+// Register a class alias for this encoder only. The first call replaces Registry
+// with a private one, which still uses the aliases of the old Registry but doesn't
+// change it.
+func (cxt *Encoder) RegisterType(flexName string, instance interface{}) {
+	if cxt.localRegistry == nil || cxt.Registry != cxt.localRegistry {
+		cxt.localRegistry = newChildRegistry(cxt.registry())
+		cxt.Registry = cxt.localRegistry
+	}
+	cxt.localRegistry.RegisterClassAlias(flexName, instance)
 }
 func (cxt *Encoder) WriteUint16(value uint16) os.Error {
 	return binary.Write(cxt.stream, binary.BigEndian, &value)
@@ -214,6 +496,13 @@ func (cxt *Encoder) WriteString(str string) os.Error {
 func (cxt *Encoder) writeByte(b uint8) os.Error {
 	return binary.Write(cxt.stream, binary.BigEndian, b)
 }
+func (cxt *Encoder) WriteUint8(value uint8) os.Error {
+	return cxt.writeByte(value)
+}
+func (cxt *Encoder) WriteBytes(data []byte) os.Error {
+	_, err := cxt.stream.Write(data)
+	return err
+}
 func (cxt *Encoder) WriteBool(b bool) {
 	val := 0x0
 	if b {
@@ -247,12 +536,73 @@ func (cxt *Decoder) ReadUint29() uint32 {
 	return result
 }
 
+// Read a 29-bit compact encoded integer, as a signed value.
+func (cxt *Decoder) ReadInt29() int32 {
+	result := cxt.ReadUint29()
+
+	// Sign-extend from 29 bits.
+	if result&0x10000000 != 0 {
+		return int32(result) - 0x20000000
+	}
+	return int32(result)
+}
+
+// The range of integers that can be written with the AMF3 integer type. Values
+// outside of this range are written as doubles.
+const (
+	minInt29 = -1 << 28
+	maxInt29 = 1<<28 - 1
+)
+
+func (cxt *Encoder) writeIntAmf3(number int64) os.Error {
+	if number >= minInt29 && number <= maxInt29 {
+		cxt.writeByte(amf3_integerType)
+		return cxt.WriteUint29(uint32(number) & 0x1fffffff)
+	}
+
+	magnitude := uint64(number)
+	if number < 0 {
+		magnitude = uint64(-number)
+	}
+	if cxt.ErrorOnPrecisionLoss && !isExactAsDouble(magnitude) {
+		return os.NewError(fmt.Sprintf("Integer can't be written as a double without "+
+			"losing precision: %d", number))
+	}
+
+	cxt.writeByte(amf3_doubleType)
+	return cxt.WriteFloat64(float64(number))
+}
+
+func (cxt *Encoder) writeUintAmf3(number uint64) os.Error {
+	if number <= math.MaxInt64 {
+		return cxt.writeIntAmf3(int64(number))
+	}
+
+	if cxt.ErrorOnPrecisionLoss && !isExactAsDouble(number) {
+		return os.NewError(fmt.Sprintf("Integer can't be written as a double without "+
+			"losing precision: %d", number))
+	}
+
+	cxt.writeByte(amf3_doubleType)
+	return cxt.WriteFloat64(float64(number))
+}
+
+// Check if a double can hold this integer exactly, which is the case when its
+// significant bits fit in the 53-bit mantissa.
+func isExactAsDouble(magnitude uint64) bool {
+	for magnitude != 0 && magnitude&1 == 0 {
+		magnitude >>= 1
+	}
+	return magnitude < 1<<53
+}
+
 func (cxt *Encoder) WriteUint29(value uint32) os.Error {
 
 	// Make sure the value is only 29 bits.
 	remainder := value & 0x1fffffff
 	if remainder != value {
-		fmt.Println("warning: WriteUint29 received a value that does not fit in 29 bits")
+		cxt.logf("warning: WriteUint29 received a value that does not fit in 29 bits: %d",
+			value)
 	}
 
 	if remainder > 0x1fffff {
@@ -299,6 +649,9 @@ func (cxt *Decoder) readStringAmf3() string {
 	}
 
 	str := cxt.ReadStringKnownLength(length)
+	if cxt.errored() || !cxt.checkReferences(len(cxt.stringTable)) {
+		return ""
+	}
 	cxt.stringTable = append(cxt.stringTable, str)
 
 	return str
@@ -307,7 +660,13 @@ func (cxt *Decoder) readStringAmf3() string {
 func (cxt *Encoder) WriteStringAmf3(s string) os.Error {
 	length := len(s)
 
-	// TODO: Support outgoing string references.
+	// The empty string is never sent as a reference.
+	if length > 0 {
+		if index, found := cxt.stringTable[s]; found {
+			return cxt.WriteUint29(uint32(index << 1))
+		}
+		cxt.stringTable[s] = len(cxt.stringTable)
+	}
 
 	cxt.WriteUint29(uint32((length << 1) + 1))
 
@@ -326,33 +685,42 @@ func (cxt *Decoder) readObjectAmf3() interface{} {
 
 	// Check the low bit to see if this is a reference
 	if (ref & 1) == 0 {
-		index := int(ref >> 1)
-		if index >= len(cxt.objectTable) {
-			cxt.saveError(os.NewError(fmt.Sprintf("Invalid object index: %d", index)))
-			return nil
-		}
-		return cxt.objectTable[index]
+		return cxt.objectReference(int(ref>>1), "object")
 	}
 
 	class := cxt.readClassDefinitionAmf3(ref)
 
+	if cxt.errored() {
+		return nil
+	}
+
+	if class.externalizable {
+		if isUnwrappedExternalClass(class.name) {
+			return cxt.readUnwrappedExternalAmf3()
+		}
+		return cxt.readExternalizableAmf3(class)
+	}
+
 	object := AvmObject{}
 	object.class = class
 
 	// For an anonymous class, just return a map[string] interface{}
 	if object.class.name == "" {
 		result := make(map[string]interface{})
-		for prop := range class.properties {
-			value := cxt.ReadValueAmf3()
-			object.staticFields[prop] = value
+
+		// Store the object in the table before doing any decoding.
+		cxt.storeObjectInTable(result)
+
+		for _, prop := range class.properties {
+			result[prop] = cxt.readNamedAmf3(prop)
 		}
 		if class.dynamic {
 			for {
 				name := cxt.readStringAmf3()
-				if name == "" {
+				if name == "" || !cxt.checkCollectionSize(len(result)+1) {
 					break
 				}
-				value := cxt.ReadValueAmf3()
+				value := cxt.readNamedAmf3(name)
 				result[name] = value
 			}
 		}
@@ -361,216 +729,556 @@ func (cxt *Decoder) readObjectAmf3() interface{} {
 
 	object.dynamicFields = make(map[string]interface{})
 
-	fmt.Printf("AvmObject class name: %s\n", class.name)
+	cxt.logf("AvmObject class name: %s", class.name)
 
 	// Store the object in the table before doing any decoding.
+	tableIndex := len(cxt.objectTable)
 	cxt.storeObjectInTable(&object)
+	cxt.beginObject(&object)
 
 	// Read static fields
-	object.staticFields = make([]interface{}, len(class.properties))
-	for i := range class.properties {
-		value := cxt.ReadValueAmf3()
-		object.staticFields[i] = value
+	object.staticFields = make([]interface{}, 0, preallocated(len(class.properties)))
+	for _, prop := range class.properties {
+		if cxt.errored() {
+			break
+		}
+		object.staticFields = append(object.staticFields, cxt.readNamedAmf3(prop))
 	}
 
-	fmt.Printf("static fields = %v\n", object.staticFields)
-	fmt.Printf("static fields = %v\n", class.properties)
+	cxt.logf("static fields %v = %v", class.properties, object.staticFields)
 
 	if class.dynamic {
 		// Parse dynamic fields
 		for {
 			name := cxt.readStringAmf3()
-			if name == "" {
+			if name == "" || !cxt.checkCollectionSize(len(object.dynamicFields)+1) {
 				break
 			}
 
-			value := cxt.ReadValueAmf3()
+			value := cxt.readNamedAmf3(name)
 			object.dynamicFields[name] = value
 		}
 	}
 
-	// If this type is registered, then unpack this result into an instance of the type.
-	// TODO: This could be faster if we didn't create an intermediate AvmObject.
-	goType, foundGoType := cxt.typeMap[class.name]
-
-	if foundGoType {
-		result := reflect.Indirect(reflect.New(goType))
-		for i := 0; i < len(class.properties); i++ {
-			value := reflect.ValueOf(object.staticFields[i])
-			fieldName := class.properties[i]
-			// The Go type will have field names with capital letters
-			fieldName = strings.ToUpper(fieldName[:1]) + fieldName[1:]
-			field := result.FieldByName(fieldName)
-			fmt.Printf("Attempting to write %v to field %v\n", object.staticFields[i],
-				class.properties[i])
-			field.Set(value)
-		}
-		return result.Interface()
+	pending := cxt.endObject()
+	if cxt.errored() {
+		return nil
 	}
 
-	return object
+	// Later references get the resolved value too.
+	result := cxt.resolveObject(pending)
+	cxt.objectTable[tableIndex] = result
+	return result
 }
 
-func (cxt *Encoder) writeObjectAmf3(value interface{}) os.Error {
-
-	fmt.Printf("writeObjectAmf3 attempting to write a value of type %s\n",
-		reflect.ValueOf(value).Type().Name())
-
-	return nil
+// A typed object that's being read. If its class is registered, pointer is the
+// instance of the registered type that it will be unpacked into.
+type pendingObject struct {
+	object     *AvmObject
+	pointer    reflect.Value
+	referenced bool
 }
 
-func (cxt *Encoder) writeAvmObject3(value *AvmObject) os.Error {
-	// TODO: Support outgoing object references.
+// Start reading the properties of a typed object. Until endObject, references to
+// it are noted, so that cycles through it can be kept when it's resolved.
+func (cxt *Decoder) beginObject(object *AvmObject) {
+	pending := pendingObject{object: object}
 
-	// writeClassDefinitionAmf3 will also write the ref section.
-	cxt.writeClassDefinitionAmf3(value.class)
+	// Properties that refer back to the object are stored as the same pointer.
+	goType, foundGoType := cxt.registry().TypeForAlias(object.class.name)
+	if foundGoType && goType.Kind() != reflect.Struct {
+		cxt.saveError(os.NewError(fmt.Sprintf(
+			"Type registered for class %s is not a struct: %v", object.class.name, goType)))
+	} else if foundGoType {
+		pending.pointer = reflect.New(goType)
+		if cxt.assignedPointers == nil {
+			cxt.assignedPointers = make(map[objectKey]reflect.Value)
+		}
+		key := objectKey{pending.pointer.Type(), reflect.ValueOf(object).Pointer(), 0}
+		cxt.assignedPointers[key] = pending.pointer
+	}
 
-	return nil
+	cxt.pendingObjects = append(cxt.pendingObjects, pending)
 }
 
-func (cxt *Encoder) writeReflectedStructAmf3(value reflect.Value) os.Error {
+// Finish reading the properties of the innermost typed object.
+func (cxt *Decoder) endObject() pendingObject {
+	last := len(cxt.pendingObjects) - 1
+	pending := cxt.pendingObjects[last]
+	cxt.pendingObjects = cxt.pendingObjects[:last]
+	return pending
+}
 
-	if value.Kind() != reflect.Struct {
-		return os.NewError("writeReflectedStructAmf3 called with non-struct value")
+// Called with the target of every object reference.
+func (cxt *Decoder) noteReference(value interface{}) {
+	object, isObject := value.(*AvmObject)
+	if !isObject {
+		return
 	}
+	for i := range cxt.pendingObjects {
+		if cxt.pendingObjects[i].object == object {
+			cxt.pendingObjects[i].referenced = true
+		}
+	}
+}
 
-	// Ref is, non-object-ref, non-class-ref, non-externalizable, non-dynamic
-	// TODO: Support object refs and class refs.
-	ref := 0x2
-
-	numFields := value.Type().NumField()
-
-	ref += numFields << 4
+// If the object's class is registered, then unpack it into an instance of the
+// registered type. Otherwise the object is returned as is. Used for both AMF3
+// objects and AMF0 typed objects.
+//
+// A struct value can't be part of a cycle, so an object that was referenced from
+// inside itself is returned as a pointer to the registered type.
+// TODO: This could be faster if we didn't create an intermediate AvmObject.
+func (cxt *Decoder) resolveObject(pending pendingObject) interface{} {
+	object := pending.object
+	class := object.class
+	pointer := pending.pointer
+
+	if !pointer.IsValid() {
+		return object
+	}
 
-	cxt.WriteUint29(uint32(ref))
+	result := pointer.Elem()
+	fields := structFields(result.Type(), cxt.FieldNaming)
+	for i := 0; i < len(class.properties); i++ {
+		cxt.logf("Attempting to write %v to field %v", object.staticFields[i],
+			class.properties[i])
+		cxt.setStructField(result, fields, class.properties[i], object.staticFields[i])
+	}
+	for name, value := range object.dynamicFields {
+		cxt.setStructField(result, fields, name, value)
+	}
+	if pending.referenced {
+		return pointer.Interface()
+	}
+	return result.Interface()
+}
 
-	// Class name
-	cxt.WriteStringAmf3(value.Type().Name())
-	fmt.Printf("wrote class name = %s\n", value.Type().Name())
+func (cxt *Decoder) setStructField(result reflect.Value, fields []structField, name string,
+	value interface{}) {
 
-	// Property names
-	for i := 0; i < numFields; i++ {
-		structField := value.Type().Field(i)
-		cxt.WriteStringAmf3(structField.Name)
-		fmt.Printf("wrote field name = %s\n", structField.Name)
+	index, found := findStructField(fields, result.Type(), name)
+	if found {
+		cxt.saveError(cxt.assignValue(result.Field(index), value))
 	}
+}
 
-	// Property values
-	for i := 0; i < numFields; i++ {
-		cxt.writeReflectedValueAmf3(value.Field(i))
+// Assign the next object index to this value. If the value (identified by pointer)
+// was already written, then write a reference to it and return true, in which case
+// the caller shouldn't write anything else. Values without an identity, such as
+// structs passed by value, always get a new index.
+func (cxt *Encoder) writeObjectReferenceAmf3(value reflect.Value) bool {
+	key, hasIdentity := identityKey(value)
+
+	if hasIdentity {
+		if index, found := cxt.objectTable[key]; found {
+			cxt.WriteUint29(uint32(index << 1))
+			return true
+		}
+		cxt.objectTable[key] = cxt.objectCount
 	}
 
-	return nil
+	cxt.objectCount++
+	return false
 }
 
-func (cxt *Decoder) readClassDefinitionAmf3(ref uint32) *AvmClass {
-	// Check for a reference to an existing class definition
-	if (ref & 2) == 0 {
-		return cxt.classTable[int(ref>>2)]
+// Returns the key that identifies value in an outgoing object table. Only pointers,
+// maps and non-empty slices have an identity.
+func identityKey(value reflect.Value) (objectKey, bool) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map:
+		return objectKey{value.Type(), value.Pointer(), 0}, !value.IsNil()
+	case reflect.Slice:
+		return objectKey{value.Type(), value.Pointer(), value.Len()}, value.Len() > 0
 	}
+	return objectKey{}, false
+}
 
-	// Parse a class definition
-	className := cxt.readStringAmf3()
+func (cxt *Encoder) writeObjectAmf3(value interface{}) os.Error {
 
-	externalizable := ref&4 != 0
-	dynamic := ref&8 != 0
-	propertyCount := ref >> 4
+	cxt.logf("writeObjectAmf3 attempting to write a value of type %s",
+		reflect.ValueOf(value).Type().Name())
 
-	class := AvmClass{className, externalizable, dynamic, make([]string, propertyCount)}
+	return nil
+}
 
-	// Property names
-	for i := uint32(0); i < propertyCount; i++ {
-		class.properties[i] = cxt.readStringAmf3()
+func (cxt *Encoder) writeAvmObject3(value *AvmObject) os.Error {
+	if cxt.writeObjectReferenceAmf3(reflect.ValueOf(value)) {
+		return nil
 	}
 
-	// Save the new class in the loopup table
-	cxt.classTable = append(cxt.classTable, &class)
-
-	fmt.Printf("read class name = %s\n", class.name)
-
-	return &class
-}
+	if value.class == nil || value.class.externalizable {
+		return os.NewError("writeAvmObject3 called with an AvmObject that has no fields")
+	}
 
-func (cxt *Encoder) writeClassDefinitionAmf3(class *AvmClass) {
-	// TODO: Support class references
-	ref := uint32(0x2)
+	// writeClassDefinitionAmf3 will also write the ref section.
+	cxt.writeClassDefinitionAmf3(value.class)
 
-	if class.externalizable {
-		ref += 0x4
-	}
-	if class.dynamic {
-		ref += 0x8
+	// Write static fields
+	for _, fieldValue := range value.staticFields {
+		if err := cxt.WriteValueAmf3(fieldValue); err != nil {
+			return err
+		}
 	}
 
-	ref += uint32(len(class.properties) << 4)
+	if !value.class.dynamic {
+		return nil
+	}
 
-	cxt.WriteUint29(ref)
+	// Write dynamic fields
+	for _, name := range cxt.sortedFieldNames(value.dynamicFields) {
+		cxt.WriteStringAmf3(name)
+		if err := cxt.WriteValueAmf3(value.dynamicFields[name]); err != nil {
+			return err
+		}
+	}
 
-	cxt.WriteStringAmf3(class.name)
+	// Write a null name to indicate the end of fields.
+	return cxt.WriteStringAmf3("")
+}
 
-	// Property names
-	for _, name := range class.properties {
-		cxt.WriteStringAmf3(name)
+// Returns the names in this field map, sorted if SortMapKeys is set.
+func (cxt *Encoder) sortedFieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
 	}
+	if cxt.SortMapKeys {
+		sort.Strings(names)
+	}
+	return names
 }
 
-func (cxt *Decoder) readArrayAmf3() interface{} {
-	ref := cxt.ReadUint29()
+// Write a struct, or a pointer to a struct. Pointers are tracked in the object table
+// so that shared and cyclic structures are sent as references.
+func (cxt *Encoder) writeReflectedStructAmf3(value reflect.Value) os.Error {
 
-	if cxt.errored() {
+	if cxt.writeObjectReferenceAmf3(value) {
 		return nil
 	}
 
-	// Check the low bit to see if this is a reference
-	if (ref & 1) == 0 {
-		index := int(ref >> 1)
-		if index >= len(cxt.objectTable) {
-			cxt.saveError(os.NewError(fmt.Sprintf("Invalid array reference: %d", index)))
-			return nil
-		}
+	value = reflect.Indirect(value)
 
-		return cxt.objectTable[index]
+	if value.Kind() != reflect.Struct {
+		return os.NewError("writeReflectedStructAmf3 called with non-struct value")
 	}
 
-	elementCount := int(ref >> 1)
+	trait := cxt.traitForType(value.Type())
 
-	// Read name-value pairs, if any.
-	key := cxt.readStringAmf3()
+	// writeClassDefinitionAmf3 will also write the ref section.
+	cxt.writeClassDefinitionAmf3(trait.class)
 
-	// No name-value pairs, return a flat Go array.
-	if key == "" {
-		result := make([]interface{}, elementCount)
-		for i := 0; i < elementCount; i++ {
-			result[i] = cxt.ReadValueAmf3()
+	// Property values
+	for _, field := range trait.sealed {
+		if err := cxt.writeReflectedValueAmf3(value.Field(field.index)); err != nil {
+			return err
 		}
-		return result
 	}
 
-	result := &AvmArray{}
-	result.fields = make(map[string]interface{})
-
-	// Store the object in the table before doing any decoding.
-	cxt.storeObjectInTable(result)
-
-	for key != "" {
-		result.fields[key] = cxt.ReadValueAmf3()
-		key = cxt.readStringAmf3()
+	if !trait.class.dynamic {
+		return nil
 	}
 
-	// Read dense elements
-	result.elements = make([]interface{}, elementCount)
-	for i := 0; i < elementCount; i++ {
-		result.elements[i] = cxt.ReadValueAmf3()
+	// Fields with omitempty are written as dynamic properties.
+	for _, field := range trait.optional {
+		fieldValue := value.Field(field.index)
+		if isEmptyValue(fieldValue) {
+			continue
+		}
+		cxt.WriteStringAmf3(field.name)
+		if err := cxt.writeReflectedValueAmf3(fieldValue); err != nil {
+			return err
+		}
 	}
 
-	return result
+	// Write a null name to indicate the end of fields.
+	return cxt.WriteStringAmf3("")
 }
 
-func (cxt *Encoder) writeReflectedArrayAmf3(value reflect.Value) os.Error {
+// Describes how a Go type is written: the class definition, and which struct fields
+// are written as sealed and dynamic (omitempty) properties.
+type typeTrait struct {
+	class    *AvmClass
+	sealed   []structField
+	optional []structField
+}
 
-	elementCount := value.Len()
+// Returns the trait used when writing instances of this type (either a struct, or
+// an Externalizable type). The trait is cached so that later instances can use a
+// trait reference.
+func (cxt *Encoder) traitForType(goType reflect.Type) *typeTrait {
+	if trait, found := cxt.typeTraits[goType]; found {
+		return trait
+	}
 
-	// TODO: Support outgoing array references
+	trait := &typeTrait{}
+	trait.class = &AvmClass{}
+	trait.class.name = goType.Name()
+	flexName, registered := cxt.registry().AliasForType(goType)
+	if registered {
+		trait.class.name = flexName
+	}
+
+	if reflect.PtrTo(goType).Implements(externalizableType) {
+		trait.class.externalizable = true
+	} else {
+		for _, field := range structFields(goType, cxt.FieldNaming) {
+			// A registered type may be a sealed ActionScript class, which can't
+			// take dynamic properties, so its omitempty fields are always written.
+			if field.omitEmpty && !registered {
+				trait.optional = append(trait.optional, field)
+			} else {
+				trait.sealed = append(trait.sealed, field)
+				trait.class.properties = append(trait.class.properties, field.name)
+			}
+		}
+		trait.class.dynamic = len(trait.optional) > 0
+	}
+
+	cxt.typeTraits[goType] = trait
+	return trait
+}
+
+func (cxt *Decoder) readExternalizableAmf3(class *AvmClass) interface{} {
+	goType, foundGoType := cxt.registry().TypeForAlias(class.name)
+
+	if !foundGoType {
+		cxt.saveError(os.NewError(fmt.Sprintf(
+			"Externalizable class is not registered: %s", class.name)))
+		return nil
+	}
+
+	result := reflect.New(goType)
+	externalizable, ok := result.Interface().(Externalizable)
+
+	if !ok {
+		cxt.saveError(os.NewError(fmt.Sprintf(
+			"Type registered for %s does not implement Externalizable", class.name)))
+		return nil
+	}
+
+	// Store the object in the table before doing any decoding.
+	cxt.storeObjectInTable(externalizable)
+
+	cxt.saveError(externalizable.ReadExternal(cxt))
+	return externalizable
+}
+
+func (cxt *Encoder) writeExternalizableAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	// WriteExternal may have a pointer receiver, so use an addressable copy.
+	if value.Kind() != reflect.Ptr {
+		addressable := reflect.New(value.Type())
+		addressable.Elem().Set(value)
+		value = addressable
+	}
+
+	// writeClassDefinitionAmf3 will also write the ref section.
+	cxt.writeClassDefinitionAmf3(cxt.traitForType(value.Type().Elem()).class)
+
+	return value.Interface().(Externalizable).WriteExternal(cxt)
+}
+
+// The trait used for Go maps: an anonymous class where every field is dynamic.
+var anonymousDynamicClass = &AvmClass{"", false, true, nil}
+
+// Write a Go map with string keys as an anonymous object.
+func (cxt *Encoder) writeReflectedMapAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	// writeClassDefinitionAmf3 will also write the ref section.
+	cxt.writeClassDefinitionAmf3(anonymousDynamicClass)
+
+	keys := value.MapKeys()
+	if cxt.SortMapKeys {
+		sort.Sort(mapKeysByName(keys))
+	}
+
+	// Write dynamic fields
+	for _, key := range keys {
+		if key.String() == "" {
+			return os.NewError("Can't write a map with an empty key as an AMF3 object")
+		}
+		cxt.WriteStringAmf3(key.String())
+		if err := cxt.writeReflectedValueAmf3(value.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+
+	// Write a null name to indicate the end of fields.
+	return cxt.WriteStringAmf3("")
+}
+
+type mapKeysByName []reflect.Value
+
+func (keys mapKeysByName) Len() int           { return len(keys) }
+func (keys mapKeysByName) Less(i, j int) bool { return keys[i].String() < keys[j].String() }
+func (keys mapKeysByName) Swap(i, j int)      { keys[i], keys[j] = keys[j], keys[i] }
+
+func (cxt *Decoder) readClassDefinitionAmf3(ref uint32) *AvmClass {
+	// Check for a reference to an existing class definition
+	if (ref & 2) == 0 {
+		index := int(ref >> 2)
+		if index >= len(cxt.classTable) {
+			cxt.saveError(os.NewError(fmt.Sprintf("Invalid class index: %d", index)))
+			return nil
+		}
+		return cxt.classTable[index]
+	}
+
+	// Parse a class definition
+	className := cxt.readStringAmf3()
+
+	externalizable := ref&4 != 0
+	dynamic := ref&8 != 0
+	propertyCount := ref >> 4
+
+	if cxt.errored() || !cxt.checkCollectionSize(int(propertyCount)) ||
+		!cxt.checkReferences(len(cxt.classTable)) {
+		return nil
+	}
+
+	class := AvmClass{className, externalizable, dynamic,
+		make([]string, 0, preallocated(int(propertyCount)))}
+
+	// Property names
+	for i := uint32(0); i < propertyCount && !cxt.errored(); i++ {
+		class.properties = append(class.properties, cxt.readStringAmf3())
+	}
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Save the new class in the loopup table
+	cxt.classTable = append(cxt.classTable, &class)
+
+	cxt.logf("read class name = %s", class.name)
+
+	return &class
+}
+
+func (cxt *Encoder) writeClassDefinitionAmf3(class *AvmClass) {
+	// Check if this class was already sent. A trait reference has the low bits 01
+	// (an inline object, with a referenced trait).
+	if index, found := cxt.traitTable[class]; found {
+		cxt.WriteUint29(uint32(index<<2) + 0x1)
+		return
+	}
+	cxt.traitTable[class] = len(cxt.traitTable)
+
+	// Ref is, non-object-ref, non-class-ref
+	ref := uint32(0x3)
+
+	if class.externalizable {
+		ref += 0x4
+	}
+	if class.dynamic {
+		ref += 0x8
+	}
+
+	ref += uint32(len(class.properties) << 4)
+
+	cxt.WriteUint29(ref)
+
+	cxt.WriteStringAmf3(class.name)
+
+	// Property names
+	for _, name := range class.properties {
+		cxt.WriteStringAmf3(name)
+	}
+}
+
+func (cxt *Decoder) readArrayAmf3() interface{} {
+	ref := cxt.ReadUint29()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "array")
+	}
+
+	elementCount := int(ref >> 1)
+	if !cxt.checkCollectionSize(elementCount) {
+		return nil
+	}
+
+	// Read name-value pairs, if any.
+	key := cxt.readStringAmf3()
+
+	// No name-value pairs, return a flat Go array.
+	if key == "" {
+		if elementCount <= maxPreallocated {
+			result := make([]interface{}, elementCount)
+
+			// Store the array in the table before doing any decoding. The slice
+			// shares its backing array, so the stored copy sees the elements as
+			// they're read.
+			cxt.storeObjectInTable(result)
+
+			for i := 0; i < elementCount; i++ {
+				result[i] = cxt.readIndexedAmf3(i)
+			}
+			return result
+		}
+
+		// Longer arrays grow as they're read, so they're only entered in the table
+		// once they're finished, and can't contain references to themselves.
+		index := len(cxt.objectTable)
+		cxt.storeObjectInTable(unfinishedValue{})
+		result := cxt.readElementsAmf3(elementCount)
+		if cxt.errored() {
+			return nil
+		}
+		cxt.objectTable[index] = result
+		return result
+	}
+
+	result := &AvmArray{}
+	result.fields = make(map[string]interface{})
+
+	// Store the object in the table before doing any decoding.
+	cxt.storeObjectInTable(result)
+
+	for key != "" && cxt.checkCollectionSize(len(result.fields)+1) {
+		result.fields[key] = cxt.readNamedAmf3(key)
+		key = cxt.readStringAmf3()
+	}
+
+	// Read dense elements
+	result.elements = cxt.readElementsAmf3(elementCount)
+	return result
+}
+
+// Read count array elements, into a slice that grows as they're read.
+func (cxt *Decoder) readElementsAmf3(count int) []interface{} {
+	result := make([]interface{}, 0, preallocated(count))
+	for i := 0; i < count && !cxt.errored(); i++ {
+		result = append(result, cxt.readIndexedAmf3(i))
+	}
+	return result
+}
+
+func (cxt *Encoder) writeReflectedArrayAmf3(value reflect.Value) os.Error {
+
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	return cxt.writeArrayElementsAmf3(value)
+}
+
+// Write the body of a flat array, without checking the object table.
+func (cxt *Encoder) writeArrayElementsAmf3(value reflect.Value) os.Error {
+	elementCount := value.Len()
 	ref := (elementCount << 1) + 1
 
 	cxt.WriteUint29(uint32(ref))
@@ -579,15 +1287,19 @@ func (cxt *Encoder) writeReflectedArrayAmf3(value reflect.Value) os.Error {
 	cxt.WriteStringAmf3("")
 
 	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value.Index(i).Interface())
+		if err := cxt.WriteValueAmf3(value.Index(i).Interface()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (cxt *Encoder) writeFlatArrayAmf3(value []interface{}) os.Error {
-	elementCount := len(value)
+	if cxt.writeObjectReferenceAmf3(reflect.ValueOf(value)) {
+		return nil
+	}
 
-	// TODO: Support outgoing array references
+	elementCount := len(value)
 	ref := (elementCount << 1) + 1
 
 	cxt.WriteUint29(uint32(ref))
@@ -597,23 +1309,29 @@ func (cxt *Encoder) writeFlatArrayAmf3(value []interface{}) os.Error {
 
 	// Write dense elements
 	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value[i])
+		if err := cxt.WriteValueAmf3(value[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (cxt *Encoder) writeMixedArray3(value *AvmArray) os.Error {
-	elementCount := len(value.elements)
+	if cxt.writeObjectReferenceAmf3(reflect.ValueOf(value)) {
+		return nil
+	}
 
-	// TODO: Support outgoing array references
+	elementCount := len(value.elements)
 	ref := (elementCount << 1) + 1
 
 	cxt.WriteUint29(uint32(ref))
 
 	// Write fields
-	for k, v := range value.fields {
-		cxt.WriteStringAmf3(k)
-		cxt.WriteValueAmf3(v)
+	for _, name := range cxt.sortedFieldNames(value.fields) {
+		cxt.WriteStringAmf3(name)
+		if err := cxt.WriteValueAmf3(value.fields[name]); err != nil {
+			return err
+		}
 	}
 
 	// Write a null name to indicate the end of fields.
@@ -621,73 +1339,381 @@ func (cxt *Encoder) writeMixedArray3(value *AvmArray) os.Error {
 
 	// Write dense elements
 	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value.elements[i])
+		if err := cxt.WriteValueAmf3(value.elements[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (cxt *Decoder) ReadValue() interface{} {
-	if cxt.AmfVersion == 0 {
-		return cxt.readValueAmf0()
+func (cxt *Decoder) readDateAmf3() interface{} {
+	ref := cxt.ReadUint29()
+
+	if cxt.errored() {
+		return nil
 	}
 
-	return cxt.ReadValueAmf3()
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "date")
+	}
+
+	// The remaining bits are unused, the value is a double containing the number
+	// of milliseconds since the epoch (UTC).
+	millis := cxt.ReadFloat64()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	result := millisecondsToTime(millis)
+	cxt.storeObjectInTable(result)
+	return result
 }
 
-func (cxt *Decoder) readValueAmf0() interface{} {
+func (cxt *Encoder) writeDateAmf3(value time.Time) os.Error {
+	// Dates are written by value, so they're never sent as references, but they
+	// still take an object index.
+	cxt.objectCount++
+	cxt.WriteUint29(1)
+	return cxt.WriteFloat64(timeToMilliseconds(value))
+}
 
-	typeMarker := cxt.ReadByte()
+func (cxt *Decoder) readByteArrayAmf3() interface{} {
+	ref := cxt.ReadUint29()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "byte array")
+	}
+
+	length := int(ref >> 1)
+	if !cxt.checkStringLength(length) {
+		return nil
+	}
+	result, err := cxt.readFull(length)
+	if n := len(result); n < length {
+		cxt.saveError(os.NewError(fmt.Sprintf(
+			"Not enough bytes in readByteArrayAmf3 (expected %d, found %d)", length, n)))
+		return nil
+	}
+	cxt.saveError(err)
+
+	cxt.storeObjectInTable(result)
+	return result
+}
+
+func (cxt *Encoder) writeByteArrayAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	cxt.WriteUint29(uint32((value.Len() << 1) + 1))
+	_, err := cxt.stream.Write(value.Bytes())
+	return err
+}
+
+// Reads an XML or XMLDocument value, both use the same layout. The isDocument flag
+// selects which Go type is returned.
+func (cxt *Decoder) readXmlAmf3(isDocument bool) interface{} {
+	ref := cxt.ReadUint29()
 
 	if cxt.errored() {
 		return nil
 	}
 
-	// Most AMF0 types are not yet supported.
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "XML")
+	}
+
+	length := int(ref >> 1)
+	str := cxt.ReadStringKnownLength(length)
+
+	if cxt.errored() {
+		return nil
+	}
+
+	var result interface{} = XML(str)
+	if isDocument {
+		result = XMLDocument(str)
+	}
+	cxt.storeObjectInTable(result)
+	return result
+}
+
+func (cxt *Encoder) writeXmlAmf3(value string) os.Error {
+	// XML values are strings in Go, so they're never sent as references, but they
+	// still take an object index.
+	cxt.objectCount++
+	cxt.WriteUint29(uint32((len(value) << 1) + 1))
+	_, err := cxt.stream.Write([]byte(value))
+	return err
+}
+
+func (cxt *Decoder) readVectorAmf3(typeMarker uint8) interface{} {
+	ref := cxt.ReadUint29()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "vector")
+	}
+
+	elementCount := int(ref >> 1)
+	fixed := cxt.ReadUint8() != 0
+
+	if cxt.errored() || !cxt.checkCollectionSize(elementCount) {
+		return nil
+	}
 
-	// Type markers
 	switch typeMarker {
-	case amf0_numberType:
-		return cxt.ReadFloat64()
-	case amf0_booleanType:
-		val := cxt.ReadUint8()
-		return val != 0
-	case amf0_stringType:
-		return cxt.ReadString()
-	case amf0_objectType:
-		result := map[string]interface{}{}
-		for true {
-			c1 := cxt.ReadByte()
-			c2 := cxt.ReadByte()
-			length := int(c1)<<8 + int(c2)
-			name := cxt.ReadStringKnownLength(length)
-			result[name] = cxt.readValueAmf0()
+	case amf3_vectorIntType:
+		result := &IntVector{fixed, make([]int32, 0, preallocated(elementCount))}
+		for i := 0; i < elementCount && !cxt.errored(); i++ {
+			result.Elements = append(result.Elements, int32(cxt.ReadUint32()))
 		}
+		cxt.storeObjectInTable(result)
 		return result
+	case amf3_vectorUintType:
+		result := &UintVector{fixed, make([]uint32, 0, preallocated(elementCount))}
+		for i := 0; i < elementCount && !cxt.errored(); i++ {
+			result.Elements = append(result.Elements, cxt.ReadUint32())
+		}
+		cxt.storeObjectInTable(result)
+		return result
+	case amf3_vectorDoubleType:
+		result := &DoubleVector{fixed, make([]float64, 0, preallocated(elementCount))}
+		for i := 0; i < elementCount && !cxt.errored(); i++ {
+			result.Elements = append(result.Elements, cxt.ReadFloat64())
+		}
+		cxt.storeObjectInTable(result)
+		return result
+	}
+
+	result := &AvmVector{}
+	result.TypeName = cxt.readStringAmf3()
+	result.Fixed = fixed
 
-	case amf0_movieClipType:
-		fmt.Printf("Movie clip type not supported")
-	case amf0_nullType:
+	// Store the object in the table before doing any decoding.
+	tableIndex := len(cxt.objectTable)
+	cxt.storeObjectInTable(result)
+
+	result.Elements = cxt.readElementsAmf3(elementCount)
+
+	if cxt.errored() {
 		return nil
-	case amf0_undefinedType:
+	}
+
+	typed, isTyped := cxt.resolveVector(result)
+	if !isTyped {
+		return result
+	}
+
+	// Later references get the typed slice too.
+	cxt.objectTable[tableIndex] = typed
+	return typed
+}
+
+// If a slice type is registered for the vector's elements, returns the elements in
+// a slice of that type. The Fixed flag is dropped.
+func (cxt *Decoder) resolveVector(vector *AvmVector) (interface{}, bool) {
+	sliceType, foundSliceType := cxt.registry().SliceTypeForAlias(vector.TypeName)
+	if !foundSliceType {
+		return nil, false
+	}
+
+	count := len(vector.Elements)
+	result := reflect.MakeSlice(sliceType, count, count)
+	for i, element := range vector.Elements {
+		if err := cxt.assignValue(result.Index(i), element); err != nil {
+			cxt.saveError(err)
+			return nil, false
+		}
+	}
+	return result.Interface(), true
+}
+
+// Write an IntVector, UintVector or DoubleVector, or a pointer to one. The type
+// marker should already be written.
+func (cxt *Encoder) writeNumericVectorAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
 		return nil
-	case amf0_referenceType:
-	case amf0_ecmaArrayType:
-	case amf0_objectEndType:
-	case amf0_strictArrayType:
-	case amf0_dateType:
-	case amf0_longStringType:
-	case amf0_unsupporedType:
-	case amf0_recordsetType:
-	case amf0_xmlObjectType:
-	case amf0_typedObjectType:
-	case amf0_avmPlusObjectType:
-		return cxt.ReadValueAmf3()
 	}
 
-	fmt.Printf("AMF0 type marker was not supported: %d", typeMarker)
+	vector := reflect.Indirect(value)
+	elements := vector.FieldByName("Elements")
+	elementCount := elements.Len()
+	cxt.WriteUint29(uint32((elementCount << 1) + 1))
+
+	fixed := uint8(0)
+	if vector.FieldByName("Fixed").Bool() {
+		fixed = 1
+	}
+	cxt.writeByte(fixed)
+
+	for i := 0; i < elementCount; i++ {
+		var err os.Error
+		switch elements.Type().Elem().Kind() {
+		case reflect.Int32:
+			err = cxt.WriteUint32(uint32(elements.Index(i).Int()))
+		case reflect.Uint32:
+			err = cxt.WriteUint32(uint32(elements.Index(i).Uint()))
+		case reflect.Float64:
+			err = cxt.WriteFloat64(elements.Index(i).Float())
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (cxt *Encoder) writeObjectVectorAmf3(value *AvmVector) os.Error {
+	if cxt.writeObjectReferenceAmf3(reflect.ValueOf(value)) {
+		return nil
+	}
+
+	elementCount := len(value.Elements)
+	cxt.WriteUint29(uint32((elementCount << 1) + 1))
+
+	fixed := uint8(0)
+	if value.Fixed {
+		fixed = 1
+	}
+	cxt.writeByte(fixed)
+
+	typeName := value.TypeName
+	if typeName == "" {
+		typeName = "*"
+	}
+	cxt.WriteStringAmf3(typeName)
+
+	for i := 0; i < elementCount; i++ {
+		if err := cxt.WriteValueAmf3(value.Elements[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cxt *Decoder) readDictionaryAmf3() interface{} {
+	ref := cxt.ReadUint29()
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Check the low bit to see if this is a reference
+	if (ref & 1) == 0 {
+		return cxt.objectReference(int(ref>>1), "dictionary")
+	}
+
+	entryCount := int(ref >> 1)
+	if !cxt.checkCollectionSize(entryCount) {
+		return nil
+	}
+
+	result := &AvmDictionary{}
+	result.WeakKeys = cxt.ReadUint8() != 0
+	result.Entries = make([]AvmDictionaryEntry, 0, preallocated(entryCount))
+
+	if cxt.errored() {
+		return nil
+	}
+
+	// Store the object in the table before doing any decoding.
+	cxt.storeObjectInTable(result)
+
+	for i := 0; i < entryCount && !cxt.errored(); i++ {
+		cxt.pushPathIndex(i)
+		key := cxt.readNamedAmf3("key")
+		value := cxt.readNamedAmf3("value")
+		result.Entries = append(result.Entries, AvmDictionaryEntry{key, value})
+		cxt.popPath()
+	}
+	return result
+}
+
+func (cxt *Encoder) writeDictionaryAmf3(value *AvmDictionary) os.Error {
+	if cxt.writeObjectReferenceAmf3(reflect.ValueOf(value)) {
+		return nil
+	}
+
+	entryCount := len(value.Entries)
+	cxt.WriteUint29(uint32((entryCount << 1) + 1))
+
+	weakKeys := uint8(0)
+	if value.WeakKeys {
+		weakKeys = 1
+	}
+	cxt.writeByte(weakKeys)
+
+	for _, entry := range value.Entries {
+		if err := cxt.WriteValueAmf3(entry.Key); err != nil {
+			return err
+		}
+		if err := cxt.WriteValueAmf3(entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a Go map with non-string keys as a (strong-keyed) Dictionary.
+func (cxt *Encoder) writeReflectedDictionaryAmf3(value reflect.Value) os.Error {
+	if cxt.writeObjectReferenceAmf3(value) {
+		return nil
+	}
+
+	keys := value.MapKeys()
+	cxt.WriteUint29(uint32((len(keys) << 1) + 1))
+
+	// Not weak-keyed.
+	cxt.writeByte(0)
+
+	for _, key := range keys {
+		if err := cxt.writeReflectedValueAmf3(key); err != nil {
+			return err
+		}
+		if err := cxt.writeReflectedValueAmf3(value.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func millisecondsToTime(millis float64) *time.Time {
+	ms := int64(millis)
+	seconds, remainder := ms/1000, ms%1000
+	if remainder < 0 {
+		seconds--
+		remainder += 1000
+	}
+	result := time.SecondsToUTC(seconds)
+	result.Nanosecond = int(remainder) * 1e6
+	return result
+}
+
+func timeToMilliseconds(t time.Time) float64 {
+	return float64(t.Seconds())*1000 + float64(t.Nanosecond/1e6)
+}
+
+func (cxt *Decoder) ReadValue() interface{} {
+	if cxt.AmfVersion == 0 {
+		return cxt.readValueAmf0()
+	}
+
+	return cxt.ReadValueAmf3()
+}
+
 func (cxt *Decoder) ReadValueAmf3() interface{} {
 
 	// Read type marker
@@ -697,15 +1723,11 @@ func (cxt *Decoder) ReadValueAmf3() interface{} {
 		return nil
 	}
 
-	// Flash Player 9 will sometimes wrap data as an AMF0 value, which just means that
-	// there might be an additional type code (amf0_avmPlusObjectType), which we can
-	// unambiguously ignore here.
+	cxt.markers = append(cxt.markers, typeMarker)
+	defer cxt.popMarker()
 
-	if typeMarker == amf0_avmPlusObjectType {
-		typeMarker = cxt.ReadByte()
-		if cxt.errored() {
-			return nil
-		}
+	if !cxt.checkLimit("Nesting depth", len(cxt.markers), cxt.Limits.MaxDepth) {
+		return nil
 	}
 
 	switch typeMarker {
@@ -716,26 +1738,31 @@ func (cxt *Decoder) ReadValueAmf3() interface{} {
 	case amf3_trueType:
 		return true
 	case amf3_integerType:
-		return cxt.ReadUint29()
+		return cxt.ReadInt29()
 	case amf3_doubleType:
 		return cxt.ReadFloat64()
 	case amf3_stringType:
 		return cxt.readStringAmf3()
 	case amf3_xmlType:
-		// TODO
+		return cxt.readXmlAmf3(true)
 	case amf3_dateType:
-		// TODO
+		return cxt.readDateAmf3()
 	case amf3_objectType:
 		return cxt.readObjectAmf3()
 	case amf3_avmPlusXmlType:
-		// TODO
+		return cxt.readXmlAmf3(false)
 	case amf3_byteArrayType:
-		// TODO
+		return cxt.readByteArrayAmf3()
 	case amf3_arrayType:
 		return cxt.readArrayAmf3()
+	case amf3_vectorIntType, amf3_vectorUintType, amf3_vectorDoubleType,
+		amf3_vectorObjectType:
+		return cxt.readVectorAmf3(typeMarker)
+	case amf3_dictionaryType:
+		return cxt.readDictionaryAmf3()
 	}
 
-	cxt.saveError(os.NewError("AMF3 type marker was not supported"))
+	cxt.saveError(os.NewError(fmt.Sprintf("AMF3 type marker was not supported: %d", typeMarker)))
 	return nil
 }
 
@@ -748,31 +1775,163 @@ func (cxt *Encoder) WriteValueAmf3(value interface{}) os.Error {
 	return cxt.writeReflectedValueAmf3(reflect.ValueOf(value))
 }
 
+var undefinedType = reflect.TypeOf(Undefined{})
+var timeType = reflect.TypeOf(time.Time{})
+var xmlType = reflect.TypeOf(XML(""))
+var xmlDocumentType = reflect.TypeOf(XMLDocument(""))
+var avmVectorType = reflect.TypeOf(&AvmVector{})
+var intVectorType = reflect.TypeOf(&IntVector{})
+var uintVectorType = reflect.TypeOf(&UintVector{})
+var doubleVectorType = reflect.TypeOf(&DoubleVector{})
+var avmDictionaryType = reflect.TypeOf(&AvmDictionary{})
+var avmObjectType = reflect.TypeOf(&AvmObject{})
+var avmArrayType = reflect.TypeOf(&AvmArray{})
+var externalizableType = reflect.TypeOf((*Externalizable)(nil)).Elem()
+
+// Value types with their own AMF form. Pointers to them are written as the value
+// they point to, before looking for a TextMarshaler.
+func isBuiltinValueType(valueType reflect.Type) bool {
+	switch valueType {
+	case undefinedType, timeType, xmlType, xmlDocumentType:
+		return true
+	}
+	return false
+}
+
 func (cxt *Encoder) writeReflectedValueAmf3(value reflect.Value) os.Error {
 
+	if value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return cxt.writeByte(amf3_nullType)
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return cxt.writeByte(amf3_nullType)
+	}
+
+	// Types can substitute another value for themselves.
+	if marshaler, ok := implementation(value, marshalerType); ok {
+		substitute, err := marshaler.(Marshaler).MarshalAMF()
+		if err != nil {
+			return err
+		}
+		return cxt.WriteValueAmf3(substitute)
+	}
+
+	if reflect.PtrTo(value.Type()).Implements(externalizableType) ||
+		value.Type().Implements(externalizableType) {
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeExternalizableAmf3(value)
+	}
+
+	switch value.Type() {
+	case undefinedType:
+		return cxt.writeByte(amf3_undefinedType)
+	case timeType:
+		cxt.writeByte(amf3_dateType)
+		return cxt.writeDateAmf3(value.Interface().(time.Time))
+	case xmlType:
+		cxt.writeByte(amf3_avmPlusXmlType)
+		return cxt.writeXmlAmf3(value.String())
+	case xmlDocumentType:
+		cxt.writeByte(amf3_xmlType)
+		return cxt.writeXmlAmf3(value.String())
+	case avmVectorType:
+		cxt.writeByte(amf3_vectorObjectType)
+		return cxt.writeObjectVectorAmf3(value.Interface().(*AvmVector))
+	case intVectorType, intVectorType.Elem():
+		cxt.writeByte(amf3_vectorIntType)
+		return cxt.writeNumericVectorAmf3(value)
+	case uintVectorType, uintVectorType.Elem():
+		cxt.writeByte(amf3_vectorUintType)
+		return cxt.writeNumericVectorAmf3(value)
+	case doubleVectorType, doubleVectorType.Elem():
+		cxt.writeByte(amf3_vectorDoubleType)
+		return cxt.writeNumericVectorAmf3(value)
+	case avmDictionaryType:
+		cxt.writeByte(amf3_dictionaryType)
+		return cxt.writeDictionaryAmf3(value.Interface().(*AvmDictionary))
+	case avmObjectType:
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeAvmObject3(value.Interface().(*AvmObject))
+	case avmObjectType.Elem():
+		object := value.Interface().(AvmObject)
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeAvmObject3(&object)
+	case avmArrayType:
+		cxt.writeByte(amf3_arrayType)
+		return cxt.writeMixedArray3(value.Interface().(*AvmArray))
+	}
+
+	if value.Kind() == reflect.Ptr && isBuiltinValueType(value.Type().Elem()) {
+		return cxt.writeReflectedValueAmf3(value.Elem())
+	}
+
+	// Otherwise, types that can write themselves as text are sent as strings.
+	if textMarshaler, ok := implementation(value, textMarshalerType); ok {
+		text, err := textMarshaler.(TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		cxt.writeByte(amf3_stringType)
+		return cxt.WriteStringAmf3(string(text))
+	}
+
 	switch value.Kind() {
 	case reflect.String:
 		cxt.writeByte(amf3_stringType)
-		str, _ := value.Interface().(string)
-		return cxt.WriteStringAmf3(str)
+		return cxt.WriteStringAmf3(value.String())
 	case reflect.Bool:
 		if value.Bool() == false {
 			return cxt.writeByte(amf3_falseType)
 		} else {
 			return cxt.writeByte(amf3_trueType)
 		}
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
-		cxt.writeByte(amf3_integerType)
-		return cxt.WriteUint29(uint32(value.Int()))
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
-		cxt.writeByte(amf3_integerType)
-		return cxt.WriteUint29(uint32(value.Uint()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cxt.writeIntAmf3(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return cxt.writeUintAmf3(value.Uint())
 	case reflect.Float32, reflect.Float64:
 		cxt.writeByte(amf3_doubleType)
 		return cxt.WriteFloat64(value.Float())
-	case reflect.Array, reflect.Slice:
+	case reflect.Slice:
+		switch value.Type().Elem().Kind() {
+		case reflect.Uint8:
+			cxt.writeByte(amf3_byteArrayType)
+			return cxt.writeByteArrayAmf3(value)
+		}
+		if cxt.UseArrayCollection {
+			cxt.writeByte(amf3_objectType)
+			return cxt.writeArrayCollectionAmf3(value)
+		}
+		cxt.writeByte(amf3_arrayType)
+		return cxt.writeReflectedArrayAmf3(value)
+	case reflect.Array:
+		if cxt.UseArrayCollection {
+			cxt.writeByte(amf3_objectType)
+			return cxt.writeArrayCollectionAmf3(value)
+		}
 		cxt.writeByte(amf3_arrayType)
 		return cxt.writeReflectedArrayAmf3(value)
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			cxt.writeByte(amf3_dictionaryType)
+			return cxt.writeReflectedDictionaryAmf3(value)
+		}
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeReflectedMapAmf3(value)
+	case reflect.Struct:
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeReflectedStructAmf3(value)
+	case reflect.Ptr:
+		if value.Elem().Kind() == reflect.Struct && value.Elem().Type() != timeType {
+			cxt.writeByte(amf3_objectType)
+			return cxt.writeReflectedStructAmf3(value)
+		}
+		return cxt.writeReflectedValueAmf3(value.Elem())
 	}
 
 	return os.NewError(fmt.Sprintf("writeReflectedArrayAmf3 doesn't support kind: %v",
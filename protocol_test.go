@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"os"
+	"reflect"
 	"testing"
+	"time"
+	"xml"
 )
 
 func testReadAmf3(t *testing.T, blobStr string, expectedStr string) {
@@ -29,6 +33,17 @@ func testReadAmf3(t *testing.T, blobStr string, expectedStr string) {
 	}
 }
 
+// Like testReadAmf3, but compares the value itself. Used for values with maps,
+// which don't print their entries in a fixed order.
+func testReadValueAmf3(t *testing.T, blobStr string, expected interface{}) {
+	blob, _ := hex.DecodeString(blobStr)
+	value, err := ReadValueAmf3(bytes.NewBuffer(blob))
+	if !reflect.DeepEqual(value, expected) || err != nil {
+		t.Errorf("Read result of %#v didn't match expected %#v for binary blob %s "+
+			"(err = %v)", value, expected, blobStr, err)
+	}
+}
+
 func testWriteAmf3(t *testing.T, value interface{}, expectedBlob string) {
 	expectedBytes, _ := hex.DecodeString(expectedBlob)
 	writer := bytes.NewBuffer(make([]byte, 0, 1))
@@ -76,7 +91,9 @@ func TestIntegers(t *testing.T) {
 	testReadAmf3(t, "047f", "127")
 	testReadAmf3(t, "048952", "1234")
 	testReadAmf3(t, "04ff7f", "16383")
-	testReadAmf3(t, "04ffffffff", "536870911")
+	testReadAmf3(t, "04ffffffff", "-1")
+	testReadAmf3(t, "04bfffffff", "268435455")
+	testReadAmf3(t, "04c0808000", "-268435456")
 	testReadAmf3(t, "049db7cd15", "123456789")
 
 	expectReadErrorAmf3(t, "04")
@@ -89,6 +106,38 @@ func TestIntegers(t *testing.T) {
 	testWriteAmf3(t, 127, "047f")
 	testWriteAmf3(t, 1234, "048952")
 	testWriteAmf3(t, 123456789, "049db7cd15")
+	testWriteAmf3(t, -1, "04ffffffff")
+	testWriteAmf3(t, 268435455, "04bfffffff")
+	testWriteAmf3(t, -268435456, "04c0808000")
+
+	// Integers outside of 29 bits are written as doubles
+	testWriteAmf3(t, 268435456, "0541b0000000000000")
+	testWriteAmf3(t, -268435457, "05c1b0000001000000")
+	testWriteAmf3(t, int64(1)<<40, "054270000000000000")
+	testWriteAmf3(t, uint64(1)<<63, "0543e0000000000000")
+
+	encoder := NewEncoder(bytes.NewBuffer(make([]byte, 0)))
+	encoder.ErrorOnPrecisionLoss = true
+	if encoder.WriteValueAmf3(int64(1)<<53+1) == nil {
+		t.Error("Expected an error for an integer that loses precision")
+	}
+	if encoder.WriteValueAmf3(uint64(1)<<63) != nil {
+		t.Error("Unexpected error for an integer that a double can hold")
+	}
+
+	// Errors for values inside other values are returned too.
+	nested := []interface{}{
+		[]int64{1<<53 + 1},
+		struct{ Count int64 }{1<<53 + 1},
+		map[string]interface{}{"count": int64(1<<53 + 1)},
+		map[int]int64{1: 1<<53 + 1},
+		struct{ Callback func() }{},
+	}
+	for _, value := range nested {
+		if encoder.WriteValueAmf3(value) == nil {
+			t.Errorf("Expected an error for a value that can't be written: %v", value)
+		}
+	}
 }
 
 func TestDoubles(t *testing.T) {
@@ -123,6 +172,154 @@ func TestStrings(t *testing.T) {
 	testWriteAmf3(t, "a", "060361")
 	testWriteAmf3(t, "Hello", "060b48656c6c6f")
 	testWriteAmf3(t, "This is a long string", "062b546869732069732061206c6f6e6720737472696e67")
+
+	// Repeated strings are sent as references, the empty string never is.
+	testReadAmf3(t, "09070106036106000600", "[a a a]")
+	testWriteAmf3(t, []string{"a", "a", "b", "a"}, "09090106036106000603620600")
+	testWriteAmf3(t, []string{"", ""}, "09050106010601")
+}
+
+func TestDates(t *testing.T) {
+	testReadAmf3(t, "08010000000000000000", "Thu Jan  1 00:00:00 UTC 1970")
+	testReadAmf3(t, "08014271f71fb04cb000", "Fri Feb 13 23:31:30 UTC 2009")
+
+	// Invalid date reference
+	expectReadErrorAmf3(t, "0802")
+	expectReadErrorAmf3(t, "08")
+	expectReadErrorAmf3(t, "08014271f71f")
+
+	testWriteAmf3(t, *time.SecondsToUTC(0), "08010000000000000000")
+	testWriteAmf3(t, *time.NanosecondsToUTC(1234567890123000000), "08014271f71fb04cb000")
+
+	// One millisecond before the epoch.
+	testWriteAmf3(t, *time.NanosecondsToUTC(-1000000), "0801bff0000000000000")
+
+	// Dates are read as a *time.Time, and can be unmarshaled into a time.Time.
+	blob, _ := hex.DecodeString("08014271f71fb04cb000")
+	var date time.Time
+	if err := Unmarshal(blob, &date); err != nil || date.Seconds() != 1234567890 ||
+		date.Nanosecond != 123000000 {
+		t.Errorf("Wrong date: %v (err = %v)", &date, err)
+	}
+}
+
+func TestByteArrays(t *testing.T) {
+	testReadAmf3(t, "0c01", "[]")
+	testReadAmf3(t, "0c07010203", "[1 2 3]")
+
+	// Invalid byte array reference
+	expectReadErrorAmf3(t, "0c02")
+	expectReadErrorAmf3(t, "0c")
+	expectReadErrorAmf3(t, "0c070102")
+
+	testWriteAmf3(t, []byte{}, "0c01")
+	testWriteAmf3(t, []byte{1, 2, 3}, "0c07010203")
+}
+
+func TestXml(t *testing.T) {
+	testReadAmf3(t, "0b093c612f3e", "<a/>")
+	testReadAmf3(t, "07093c612f3e", "<a/>")
+
+	// Each marker is read as its own type, so it's written back the same way.
+	blob, _ := hex.DecodeString("0b093c612f3e")
+	if value, err := ReadValueAmf3(bytes.NewBuffer(blob)); value != XML("<a/>") || err != nil {
+		t.Errorf("Expected an XML, got: %#v (err = %v)", value, err)
+	}
+	blob, _ = hex.DecodeString("07093c612f3e")
+	if value, err := ReadValueAmf3(bytes.NewBuffer(blob)); value != XMLDocument("<a/>") ||
+		err != nil {
+		t.Errorf("Expected an XMLDocument, got: %#v (err = %v)", value, err)
+	}
+
+	// Invalid XML reference
+	expectReadErrorAmf3(t, "0b02")
+	expectReadErrorAmf3(t, "0b093c61")
+
+	testWriteAmf3(t, XML("<a/>"), "0b093c612f3e")
+	testWriteAmf3(t, XMLDocument("<a/>"), "07093c612f3e")
+
+	var parsed struct {
+		XMLName xml.Name
+	}
+	err := XML(`<item name="x"/>`).Unmarshal(&parsed)
+	if err != nil || parsed.XMLName.Local != "item" {
+		t.Errorf("XML.Unmarshal failed, result = %v, err = %v", parsed, err)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	testReadAmf3(t, "0d0100", "&{false []}")
+	testReadAmf3(t, "0d070000000001ffffffff00000003", "&{false [1 -1 3]}")
+	testReadAmf3(t, "0e050100000001ffffffff", "&{true [1 4294967295]}")
+	testReadAmf3(t, "0f03003ff0000000000000", "&{false [1]}")
+	testReadAmf3(t, "10050103610401060362", "&{a true [1 b]}")
+
+	// Invalid vector reference
+	expectReadErrorAmf3(t, "0d02")
+	expectReadErrorAmf3(t, "0d05000000000100")
+	expectReadErrorAmf3(t, "1005010361")
+
+	testWriteAmf3(t, IntVector{false, []int32{}}, "0d0100")
+	testWriteAmf3(t, &IntVector{false, []int32{1, -1, 3}}, "0d070000000001ffffffff00000003")
+	testWriteAmf3(t, &UintVector{true, []uint32{1, 4294967295}}, "0e050100000001ffffffff")
+	testWriteAmf3(t, DoubleVector{false, []float64{1}}, "0f03003ff0000000000000")
+	testWriteAmf3(t, &AvmVector{"a", true, []interface{}{1, "b"}}, "10050103610401060362")
+	testWriteAmf3(t, &AvmVector{"", false, []interface{}{}}, "100100032a")
+
+	// Plain slices are Arrays.
+	testWriteAmf3(t, []int32{1, 2}, "09050104010402")
+	testWriteAmf3(t, []float64{1.5}, "090301053ff8000000000000")
+
+	// Vectors of a class registered with a slice are read into that slice, and so
+	// are references to them.
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.example.Size", []Size{})
+	vector := &AvmVector{"com.example.Size", false, []interface{}{Size{2, 3}}}
+	buffer := bytes.NewBuffer(nil)
+	encoder := NewEncoder(buffer)
+	encoder.Registry = registry
+	encoder.WriteValueAmf3([]interface{}{vector, vector})
+
+	decoder := NewDecoder(buffer, 3)
+	decoder.Registry = registry
+	value := decoder.ReadValueAmf3()
+	expected := []interface{}{[]Size{{2, 3}}, []Size{{2, 3}}}
+	if !reflect.DeepEqual(value, expected) || decoder.decodeError != nil {
+		t.Errorf("Expected typed slices, got: %#v (err = %v)", value, decoder.decodeError)
+	}
+
+	// The slice doesn't keep the fixed flag or the element class name, so it's
+	// written back as an Array.
+	buffer = bytes.NewBuffer(nil)
+	encoder = NewEncoder(buffer)
+	encoder.Registry = registry
+	encoder.WriteValueAmf3(&AvmVector{"com.example.Size", true, []interface{}{}})
+	decoder = NewDecoder(buffer, 3)
+	decoder.Registry = registry
+	value = decoder.ReadValueAmf3()
+	if _, isSlice := value.([]Size); !isSlice || decoder.decodeError != nil {
+		t.Errorf("Expected a typed slice, got: %#v (err = %v)", value, decoder.decodeError)
+	}
+	testWriteAmf3(t, value, "090101")
+}
+
+func TestDictionaries(t *testing.T) {
+	testReadAmf3(t, "110100", "&{false []}")
+	testReadAmf3(t, "110301040106076f6e65", "&{true [{1 one}]}")
+	testReadAmf3(t, "1103000a0b0101060361", "&{false [{map[] a}]}")
+
+	// Invalid dictionary reference
+	expectReadErrorAmf3(t, "1102")
+	expectReadErrorAmf3(t, "1103000401")
+
+	testWriteAmf3(t, &AvmDictionary{}, "110100")
+	testWriteAmf3(t, &AvmDictionary{true, []AvmDictionaryEntry{{1, "one"}}},
+		"110301040106076f6e65")
+	testWriteAmf3(t, map[int]string{1: "one"}, "110300040106076f6e65")
+}
+
+type Node struct {
+	Next *Node
 }
 
 func TestObjects(t *testing.T) {
@@ -130,6 +327,156 @@ func TestObjects(t *testing.T) {
 	// Invalid object reference
 	expectReadErrorAmf3(t, "0a02")
 
+	// Anonymous object with a sealed and a dynamic field
+	testReadValueAmf3(t, "0a1b0103610401036206036301",
+		map[string]interface{}{"a": int32(1), "b": "c"})
+
+	// A cyclic structure is sent as a reference to itself
+	node := &Node{}
+	node.Next = node
+	testWriteAmf3(t, node, "0a13094e6f6465094e6578740a00")
+
+	// Later instances of a class use a trait reference
+	testReadAmf3(t, "0905010a0b0103610401010a0100040201", "[map[a:1] map[a:2]]")
+	testWriteAmf3(t, []Node{{}, {}}, "0905010a13094e6f6465094e657874010a0101")
+
+	// Invalid class reference
+	expectReadErrorAmf3(t, "0a05")
+
+	// Maps are written as anonymous dynamic objects
+	testWriteAmf3(t, map[string]interface{}{}, "0a0b0101")
+	testWriteAmf3(t, map[string]int{"a": 1}, "0a0b010361040101")
+	testWriteAmf3(t, []map[string]int{{"a": 1}, {"a": 2}}, "0905010a0b0103610401010a0100040201")
+
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.SortMapKeys = true
+	encoder.WriteValueAmf3(map[string]interface{}{"c": 3, "b": 2, "a": 1})
+	if hex.EncodeToString(writer.Bytes()) != "0a0b0103610401036204020363040301" {
+		t.Errorf("Wrong encoding for map with sorted keys: %x", writer.Bytes())
+	}
+
+	if WriteValueAmf3(writer, map[string]int{"": 1}) == nil {
+		t.Error("Expected an error when writing a map with an empty key")
+	}
+}
+
+type Point struct {
+	X, Y float64
+}
+
+func (p *Point) ReadExternal(cxt *Decoder) os.Error {
+	p.X = cxt.ReadFloat64()
+	p.Y = cxt.ReadFloat64()
+	return nil
+}
+
+func (p *Point) WriteExternal(cxt *Encoder) os.Error {
+	cxt.WriteFloat64(p.X)
+	return cxt.WriteFloat64(p.Y)
+}
+
+func TestExternalizable(t *testing.T) {
+	const blob = "0a071d636f6d2e61636d652e506f696e74" +
+		"3ff00000000000004000000000000000"
+	data, _ := hex.DecodeString(blob)
+
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.acme.Point", Point{})
+
+	decoder := NewDecoder(bytes.NewBuffer(data), 3)
+	decoder.Registry = registry
+	value := decoder.ReadValueAmf3()
+	if decoder.decodeError != nil {
+		t.Errorf("Error while reading externalizable: %v", decoder.decodeError)
+	}
+	if point, ok := value.(*Point); !ok || *point != (Point{1, 2}) {
+		t.Errorf("Wrong externalizable value: %v", value)
+	}
+
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.Registry = registry
+	encoder.WriteValueAmf3(Point{1, 2})
+	if hex.EncodeToString(writer.Bytes()) != blob {
+		t.Errorf("Wrong externalizable encoding: %x", writer.Bytes())
+	}
+
+	// Unregistered externalizable class
+	expectReadErrorAmf3(t, blob)
+}
+
+// Decode a blob, then check that encoding the result gives the same bytes.
+func testRoundTripAmf3(t *testing.T, blobStr string) {
+	blob, _ := hex.DecodeString(blobStr)
+	value, err := ReadValueAmf3(bytes.NewBuffer(blob))
+	if err != nil {
+		t.Errorf("Received error while reading %s: %v", blobStr, err)
+		return
+	}
+
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.SortMapKeys = true
+	err = encoder.WriteValueAmf3(value)
+
+	if hex.EncodeToString(writer.Bytes()) != blobStr {
+		t.Errorf("Round trip of %s gave %x", blobStr, writer.Bytes())
+	}
+	if err != nil {
+		t.Errorf("Received error while writing '%v': %v", value, err)
+	}
+}
+
+func TestAvmValues(t *testing.T) {
+	// Typed object with a sealed and a dynamic field
+	testRoundTripAmf3(t, "0a1b07466f6f03610401036206037801")
+
+	// Typed object that refers to itself
+	testRoundTripAmf3(t, "0a1307466f6f03610a00")
+
+	// Mixed array
+	testRoundTripAmf3(t, "09070361060b6170706c650362060d62616e616e6101040104020403")
+
+	blob, _ := hex.DecodeString("0a1b07466f6f03610401036206037801")
+	value, _ := ReadValueAmf3(bytes.NewBuffer(blob))
+	object := value.(*AvmObject)
+	a, _ := object.Get("a")
+	b, _ := object.Get("b")
+	if object.ClassName() != "Foo" || fmt.Sprint(a) != "1" || b != "x" {
+		t.Errorf("Wrong object contents: %v", object)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	// The same array sent twice
+	testReadAmf3(t, "09050109030104010902", "[[1] [1]]")
+
+	// Arrays, dates and byte arrays all share the object table
+	testReadAmf3(t, "0907010801000000000000000009030104010904",
+		"[Thu Jan  1 00:00:00 UTC 1970 [1] [1]]")
+
+	shared := []int{1}
+	testWriteAmf3(t, []interface{}{shared, shared}, "09050109030104010902")
+	testWriteAmf3(t, []interface{}{*time.SecondsToUTC(0), shared, shared},
+		"0907010801000000000000000009030104010904")
+
+	// Empty slices have no identity, so they're never references
+	testWriteAmf3(t, []interface{}{shared, shared[:0]}, "0905010903010401090101")
+
+	// A struct and its first field have the same address, but a different type,
+	// so they aren't references to each other
+	frame := &Frame{Size{1, 2}}
+	testWriteAmf3(t, []interface{}{frame, &frame.Size}, "0905010a130b4672616d650953697a65"+
+		"0a23020b57696474680d486569676874040104020a0504010402")
+}
+
+type Size struct {
+	Width, Height int
+}
+
+type Frame struct {
+	Size Size
 }
 
 func TestArrays(t *testing.T) {
@@ -139,8 +486,9 @@ func TestArrays(t *testing.T) {
 	testReadAmf3(t, "090701040104020403", "[1 2 3]")
 
 	// Mixed array
-	testReadAmf3(t, "09070361060b6170706c650362060d62616e616e6101040104020403",
-		"&{[1 2 3] map[a:apple b:banana]}")
+	testReadValueAmf3(t, "09070361060b6170706c650362060d62616e616e6101040104020403",
+		&AvmArray{[]interface{}{int32(1), int32(2), int32(3)},
+			map[string]interface{}{"a": "apple", "b": "banana"}})
 
 	expectReadErrorAmf3(t, "09")
 	expectReadErrorAmf3(t, "0900")
@@ -153,6 +501,47 @@ func TestArrays(t *testing.T) {
 	testWriteAmf3(t, []int{1, 2, 3}, "090701040104020403")
 }
 
+type testLogger struct {
+	messages []string
+}
+
+func (logger *testLogger) Printf(format string, v ...interface{}) {
+	logger.messages = append(logger.messages, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	blob, _ := hex.DecodeString("0a1307466f6f03610401")
+	logger := &testLogger{}
+	decoder := NewDecoder(bytes.NewBuffer(blob), 3)
+	decoder.Logger = logger
+	decoder.ReadValueAmf3()
+
+	if len(logger.messages) == 0 || logger.messages[0] != "read class name = Foo" {
+		t.Errorf("Wrong log output: %v", logger.messages)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// {a: [1, <string cut short>]}
+	blob, _ := hex.DecodeString("0a0b010361090501040106096162")
+	_, err := ReadValueAmf3(bytes.NewBuffer(blob))
+
+	decodeErr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("Expected a *DecodeError, got: %v", err)
+	}
+	if decodeErr.Offset != 14 || decodeErr.Marker != amf3_stringType || decodeErr.Path != "a[1]" {
+		t.Errorf("Wrong error position: offset %d, marker %d, path %q", decodeErr.Offset,
+			decodeErr.Marker, decodeErr.Path)
+	}
+
+	// A marker that can't be read has no value to describe.
+	_, err = ReadValueAmf3(bytes.NewBuffer(nil))
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Marker != -1 || decodeErr.Path != "" {
+		t.Errorf("Wrong error for empty stream: %v", err)
+	}
+}
+
 func TestOther(t *testing.T) {
 	expectReadErrorAmf3(t, "ff")
 }
@@ -0,0 +1,102 @@
+package amf
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+   Flash MX Remoting clients read query results as an mx.remoting.RecordSet. On the
+   wire this is a typed object named "RecordSet" with a single "serverInfo"
+   property, which holds the column names and all of the rows:
+
+     serverInfo: {
+       totalCount:  number of rows
+       initialData: array of rows, each an array of values
+       cursor:      1
+       serviceName: "PageAbleResult"
+       columnNames: array of names
+       version:     1
+       id:          page id, unused when all rows are sent
+     }
+*/
+
+const recordSetClassName = "RecordSet"
+
+var recordSetClass = &AvmClass{recordSetClassName, false, false, []string{"serverInfo"}}
+
+var serverInfoClass = &AvmClass{"", false, false, []string{"totalCount", "initialData",
+	"cursor", "serviceName", "columnNames", "version", "id"}}
+
+// A table of results for Flash Remoting clients. Each row has one value per
+// column.
+type RecordSet struct {
+	ColumnNames []string
+	Rows        [][]interface{}
+}
+
+// Write the RecordSet in the shape that mx.remoting.RecordSet expects.
+func (rs RecordSet) MarshalAMF() (interface{}, os.Error) {
+	rows := rs.Rows
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	columnNames := rs.ColumnNames
+	if columnNames == nil {
+		columnNames = []string{}
+	}
+
+	serverInfo := &AvmObject{}
+	serverInfo.class = serverInfoClass
+	serverInfo.staticFields = []interface{}{len(rows), rows, 1, "PageAbleResult",
+		columnNames, 1, ""}
+
+	result := &AvmObject{}
+	result.class = recordSetClass
+	result.staticFields = []interface{}{serverInfo}
+	return result, nil
+}
+
+// Read a RecordSet from a decoded object with a serverInfo property.
+func (rs *RecordSet) UnmarshalAMF(value interface{}) os.Error {
+	serverInfo, found := objectField(value, "serverInfo")
+	if !found {
+		return os.NewError("RecordSet has no serverInfo")
+	}
+
+	names, _ := objectField(serverInfo, "columnNames")
+	nameList, ok := names.([]interface{})
+	if !ok {
+		return os.NewError(fmt.Sprintf("Wrong RecordSet column names: %v", names))
+	}
+	rs.ColumnNames = make([]string, len(nameList))
+	for i, name := range nameList {
+		rs.ColumnNames[i] = fmt.Sprint(name)
+	}
+
+	data, _ := objectField(serverInfo, "initialData")
+	rowList, ok := data.([]interface{})
+	if !ok {
+		return os.NewError(fmt.Sprintf("Wrong RecordSet data: %v", data))
+	}
+	rs.Rows = make([][]interface{}, len(rowList))
+	for i, row := range rowList {
+		if rs.Rows[i], ok = row.([]interface{}); !ok {
+			return os.NewError(fmt.Sprintf("Wrong RecordSet row: %v", row))
+		}
+	}
+	return nil
+}
+
+// Returns a property of a decoded object, which is either an AvmObject or an
+// anonymous object map.
+func objectField(object interface{}, name string) (interface{}, bool) {
+	switch object := object.(type) {
+	case *AvmObject:
+		return object.Get(name)
+	case map[string]interface{}:
+		value, found := object[name]
+		return value, found
+	}
+	return nil, false
+}
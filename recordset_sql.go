@@ -0,0 +1,37 @@
+package amf
+
+import (
+	"exp/sql"
+	"os"
+)
+
+// Build a RecordSet from the remaining rows of a query. Text columns that the
+// driver returns as []byte are stored as strings.
+func NewRecordSetFromRows(rows *sql.Rows) (*RecordSet, os.Error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RecordSet{ColumnNames: columns}
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range row {
+			pointers[i] = &row[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, value := range row {
+			if bytes, ok := value.([]byte); ok {
+				row[i] = string(bytes)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package amf
+
+import (
+	"exp/sql"
+	"exp/sql/driver"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// A driver with canned results. The query "people" returns two rows, and "broken"
+// fails after the first row.
+type stubDriver struct{}
+
+type stubConn struct{}
+
+type stubStmt struct {
+	query string
+}
+
+type stubRows struct {
+	rows [][]interface{}
+	err  os.Error
+}
+
+func (stubDriver) Open(name string) (driver.Conn, os.Error) {
+	return stubConn{}, nil
+}
+
+func (stubConn) Prepare(query string) (driver.Stmt, os.Error) {
+	return &stubStmt{query}, nil
+}
+
+func (stubConn) Close() os.Error {
+	return nil
+}
+
+func (stubConn) Begin() (driver.Tx, os.Error) {
+	return nil, os.NewError("Transactions aren't supported")
+}
+
+func (stmt *stubStmt) Close() os.Error {
+	return nil
+}
+
+func (stmt *stubStmt) NumInput() int {
+	return 0
+}
+
+func (stmt *stubStmt) Exec(args []interface{}) (driver.Result, os.Error) {
+	return nil, os.NewError("Exec isn't supported")
+}
+
+func (stmt *stubStmt) Query(args []interface{}) (driver.Rows, os.Error) {
+	// Text is returned as []byte, like most drivers do.
+	rows := &stubRows{}
+	rows.rows = [][]interface{}{{[]byte("Sam"), int64(5)}, {[]byte("Ann"), int64(2)}}
+	if stmt.query == "broken" {
+		rows.rows = rows.rows[:1]
+		rows.err = os.NewError("Connection lost")
+	}
+	return rows, nil
+}
+
+func (rows *stubRows) Columns() []string {
+	return []string{"name", "cats"}
+}
+
+func (rows *stubRows) Close() os.Error {
+	return nil
+}
+
+func (rows *stubRows) Next(dest []interface{}) os.Error {
+	if len(rows.rows) == 0 {
+		if rows.err != nil {
+			return rows.err
+		}
+		return os.EOF
+	}
+	for i, value := range rows.rows[0] {
+		dest[i] = value
+	}
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("amfstub", stubDriver{})
+}
+
+func TestNewRecordSetFromRows(t *testing.T) {
+	db, err := sql.Open("amfstub", "")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("people")
+	if err != nil {
+		t.Fatalf("Query returned error: %v", err)
+	}
+	recordSet, err := NewRecordSetFromRows(rows)
+	if err != nil {
+		t.Fatalf("NewRecordSetFromRows returned error: %v", err)
+	}
+	if fmt.Sprint(*recordSet) != "{[name cats] [[Sam 5] [Ann 2]]}" {
+		t.Errorf("Wrong RecordSet: %v", *recordSet)
+	}
+	if _, isString := recordSet.Rows[0][0].(string); !isString {
+		t.Errorf("Text column wasn't stored as a string: %#v", recordSet.Rows[0][0])
+	}
+
+	// An error that ends the rows early is returned.
+	rows, err = db.Query("broken")
+	if err != nil {
+		t.Fatalf("Query returned error: %v", err)
+	}
+	if recordSet, err = NewRecordSetFromRows(rows); err == nil {
+		t.Errorf("Expected an error for rows that failed, got: %v", *recordSet)
+	}
+}
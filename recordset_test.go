@@ -0,0 +1,46 @@
+package amf
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRecordSet(t *testing.T) {
+	recordSet := RecordSet{
+		ColumnNames: []string{"name", "cats"},
+		Rows:        [][]interface{}{{"Sam", 5}, {"Ann", 2}},
+	}
+
+	data, err := MarshalAmf0(recordSet)
+	if err != nil {
+		t.Fatalf("MarshalAmf0 returned error: %v", err)
+	}
+
+	// A typed object named RecordSet, with a serverInfo object.
+	prefix := "100009" + hex.EncodeToString([]byte("RecordSet")) +
+		"000a" + hex.EncodeToString([]byte("serverInfo")) + "03" +
+		"000a" + hex.EncodeToString([]byte("totalCount")) + "004000000000000000"
+	if blob := hex.EncodeToString(data); !strings.HasPrefix(blob, prefix) {
+		t.Errorf("Wrong RecordSet encoding: %s", blob)
+	}
+
+	var result RecordSet
+	if err := UnmarshalAmf0(data, &result); err != nil {
+		t.Fatalf("UnmarshalAmf0 returned error: %v", err)
+	}
+	if fmt.Sprint(result) != "{[name cats] [[Sam 5] [Ann 2]]}" {
+		t.Errorf("Wrong RecordSet after AMF0 round trip: %v", result)
+	}
+
+	// The same shape works in AMF3.
+	data, _ = Marshal(&recordSet)
+	result = RecordSet{}
+	if err := Unmarshal(data, &result); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	if fmt.Sprint(result) != "{[name cats] [[Sam 5] [Ann 2]]}" {
+		t.Errorf("Wrong RecordSet after AMF3 round trip: %v", result)
+	}
+}
@@ -0,0 +1,115 @@
+package amf
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Maps Flex class aliases (such as "com.acme.Customer") to Go types, in both
+// directions. This is the Go side of registerClassAlias in ActionScript: Decoders
+// unpack objects of a registered class into the Go type, and Encoders write the Go
+// type with the class alias. A Registry is safe for concurrent use.
+type Registry struct {
+	mutex   sync.RWMutex
+	types   map[string]reflect.Type
+	aliases map[reflect.Type]string
+
+	// Slice types for Vectors, by the alias of their elements.
+	sliceTypes map[string]reflect.Type
+
+	// Where aliases that aren't registered here are looked up, if set.
+	parent *Registry
+}
+
+// Returns a Registry that knows the built-in Flex classes.
+func NewRegistry() *Registry {
+	registry := newChildRegistry(nil)
+	registry.registerBuiltinAliases()
+	return registry
+}
+
+// Returns an empty Registry that uses the aliases of parent, unless it has its own.
+// Registering an alias in it doesn't change parent.
+func newChildRegistry(parent *Registry) *Registry {
+	registry := &Registry{}
+	registry.types = make(map[string]reflect.Type)
+	registry.aliases = make(map[reflect.Type]string)
+	registry.sliceTypes = make(map[string]reflect.Type)
+	registry.parent = parent
+	return registry
+}
+
+// Flex classes that are used by the remoting protocol itself.
+func (registry *Registry) registerBuiltinAliases() {
+	registry.RegisterClassAlias("flex.messaging.messages.RemotingMessage",
+		FlexRemotingMessage{})
+}
+
+// The registry used by Decoders and Encoders that don't have their own.
+var DefaultRegistry = NewRegistry()
+
+// Register a class alias in DefaultRegistry.
+func RegisterClassAlias(alias string, instance interface{}) {
+	DefaultRegistry.RegisterClassAlias(alias, instance)
+}
+
+// Register the type of instance under this class alias. Either a value or a
+// pointer can be passed, both register the value type. A slice (such as
+// []Customer{}) registers its element type, and Vectors of the class are then
+// decoded into that slice type. The slice has no room for the Vector's fixed flag,
+// so register the element type alone to keep decoding Vectors as AvmVectors.
+func (registry *Registry) RegisterClassAlias(alias string, instance interface{}) {
+	goType := reflect.TypeOf(instance)
+	var sliceType reflect.Type
+	if goType.Kind() == reflect.Slice {
+		sliceType = goType
+		goType = goType.Elem()
+	}
+	if goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.types[alias] = goType
+	registry.aliases[goType] = alias
+	if sliceType != nil {
+		registry.sliceTypes[alias] = sliceType
+	}
+}
+
+func (registry *Registry) TypeForAlias(alias string) (reflect.Type, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	goType, found := registry.types[alias]
+	if !found && registry.parent != nil {
+		return registry.parent.TypeForAlias(alias)
+	}
+	return goType, found
+}
+
+func (registry *Registry) AliasForType(goType reflect.Type) (string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	alias, found := registry.aliases[goType]
+	if !found && registry.parent != nil {
+		return registry.parent.AliasForType(goType)
+	}
+	return alias, found
+}
+
+// The slice type that Vectors of this class alias are decoded into, if one was
+// registered.
+func (registry *Registry) SliceTypeForAlias(alias string) (reflect.Type, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	sliceType, found := registry.sliceTypes[alias]
+	if !found && registry.parent != nil {
+		return registry.parent.SliceTypeForAlias(alias)
+	}
+	return sliceType, found
+}
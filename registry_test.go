@@ -0,0 +1,124 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type Customer struct {
+	Name string
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.acme.Customer", &Customer{})
+
+	goType, found := registry.TypeForAlias("com.acme.Customer")
+	if !found || goType != reflect.TypeOf(Customer{}) {
+		t.Errorf("Wrong type for alias: %v", goType)
+	}
+	alias, found := registry.AliasForType(reflect.TypeOf(Customer{}))
+	if !found || alias != "com.acme.Customer" {
+		t.Errorf("Wrong alias for type: %v", alias)
+	}
+	if _, found := DefaultRegistry.TypeForAlias("com.acme.Customer"); found {
+		t.Error("Alias was registered in DefaultRegistry")
+	}
+
+	// Every registry knows the built-in Flex classes
+	goType, found = registry.TypeForAlias("flex.messaging.messages.RemotingMessage")
+	if !found || goType != reflect.TypeOf(FlexRemotingMessage{}) {
+		t.Errorf("Wrong type for built-in alias: %v", goType)
+	}
+
+	// The alias is used in both directions
+	const blob = "0a1323636f6d2e61636d652e437573746f6d6572094e616d65060341"
+	writer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(writer)
+	encoder.Registry = registry
+	encoder.WriteValueAmf3(Customer{"A"})
+	if hex.EncodeToString(writer.Bytes()) != blob {
+		t.Errorf("Wrong encoding for registered type: %x", writer.Bytes())
+	}
+
+	decoder := NewDecoder(writer, 3)
+	decoder.Registry = registry
+	value := decoder.ReadValueAmf3()
+	if customer, ok := value.(Customer); !ok || customer.Name != "A" {
+		t.Errorf("Wrong decoded value for registered type: %v", value)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	decoder := NewDecoder(nil, 3)
+	decoder.RegisterType("com.acme.Customer", Customer{})
+	if _, found := decoder.registry().TypeForAlias("com.acme.Customer"); !found {
+		t.Error("Alias wasn't registered in the decoder")
+	}
+	_, found := decoder.registry().TypeForAlias("flex.messaging.messages.RemotingMessage")
+	if !found {
+		t.Error("Decoder lost the aliases of its Registry")
+	}
+
+	encoder := NewEncoder(nil)
+	encoder.RegisterType("com.acme.Customer", Customer{})
+	alias, _ := encoder.registry().AliasForType(reflect.TypeOf(Customer{}))
+	if alias != "com.acme.Customer" {
+		t.Errorf("Wrong alias for type in encoder: %v", alias)
+	}
+
+	if _, found := DefaultRegistry.TypeForAlias("com.acme.Customer"); found {
+		t.Error("RegisterType changed DefaultRegistry")
+	}
+}
+
+func TestRegisteredNonStruct(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.acme.Customer", 0)
+
+	blobs := map[uint16]string{
+		3: "0a1323636f6d2e61636d652e437573746f6d6572094e616d65060341",
+		0: "100011636f6d2e61636d652e437573746f6d657200044e616d6502000141000009",
+	}
+	for amfVersion, blobStr := range blobs {
+		blob, _ := hex.DecodeString(blobStr)
+		decoder := NewDecoder(bytes.NewBuffer(blob), amfVersion)
+		decoder.Registry = registry
+		var value interface{}
+		err := decoder.Decode(&value)
+		if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("AMF%d: expected a DecodeError for a non-struct type, got %v (%v)",
+				amfVersion, err, value)
+		}
+	}
+}
+
+func TestRegisteredReferences(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterClassAlias("com.acme.Customer", Customer{})
+
+	// A reference to a registered object gets the same value as the object.
+	customer := &Customer{"A"}
+	expected := []interface{}{Customer{"A"}, Customer{"A"}}
+	for _, amfVersion := range []uint16{0, 3} {
+		buffer := bytes.NewBuffer(nil)
+		encoder := NewEncoder(buffer)
+		encoder.Registry = registry
+		if amfVersion == 0 {
+			encoder.WriteValueAmf0([]interface{}{customer, customer})
+		} else {
+			encoder.WriteValueAmf3([]interface{}{customer, customer})
+		}
+		encoded := hex.EncodeToString(buffer.Bytes())
+
+		decoder := NewDecoder(buffer, amfVersion)
+		decoder.Registry = registry
+		value := decoder.ReadValue()
+		if !reflect.DeepEqual(value, expected) || decoder.decodeError != nil {
+			t.Errorf("AMF%d: wrong value for %s: %#v (err = %v)", amfVersion, encoded,
+				value, decoder.decodeError)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package amf
 
 import (
-	"fmt"
+	"bytes"
 	"io"
 	"os"
 )
@@ -62,10 +62,16 @@ type AmfMessage struct {
 	Body        interface{}
 }
 
+// Read a message bundle, within DefaultDecodeLimits.
 func DecodeMessageBundle(stream io.Reader) (*MessageBundle, os.Error) {
+	decoder := NewDecoder(stream, 0)
+	decoder.Limits = DefaultDecodeLimits
+	return ReadMessageBundle(decoder)
+}
 
-	cxt := NewDecoder(stream, 0)
-	cxt.RegisterType("flex.messaging.messages.RemotingMessage", FlexRemotingMessage{})
+// Read a message bundle using this decoder, so that its settings (such as the
+// Registry) are used for the message contents.
+func ReadMessageBundle(cxt *Decoder) (*MessageBundle, os.Error) {
 
 	amfVersion := cxt.ReadUint16()
 
@@ -104,20 +110,25 @@ func DecodeMessageBundle(stream io.Reader) (*MessageBundle, os.Error) {
 	*/
 
 	// Read headers
-	result.Headers = make([]Header, headerCount)
-	for i := 0; i < int(headerCount); i++ {
+	result.Headers = make([]Header, 0, preallocated(int(headerCount)))
+	for i := 0; i < int(headerCount) && !cxt.errored(); i++ {
+		cxt.resetTables()
+
 		name := cxt.ReadString()
 		mustUnderstand := cxt.ReadUint8() != 0
 		messageLength := cxt.ReadUint32()
 		unused(messageLength)
 
-		// TODO: Check for AMF3 type marker?
-
-		value := cxt.ReadValue()
-		header := Header{name, mustUnderstand, value}
-		result.Headers[i] = header
+		// Envelope values are always AMF0, Flash Player 9 switches to AMF3 with
+		// the avmplus type marker.
+		cxt.pushPathName("headers")
+		cxt.pushPathName(name)
+		value := cxt.readValueAmf0()
+		cxt.popPath()
+		cxt.popPath()
+		result.Headers = append(result.Headers, Header{name, mustUnderstand, value})
 
-		fmt.Printf("Read header, name = %s", name)
+		cxt.logf("Read header, name = %s", name)
 	}
 
 	/*
@@ -134,46 +145,44 @@ func DecodeMessageBundle(stream io.Reader) (*MessageBundle, os.Error) {
 
 	// Read message bodies
 	messageCount := cxt.ReadUint16()
-	result.Messages = make([]AmfMessage, messageCount)
+	result.Messages = make([]AmfMessage, 0, preallocated(int(messageCount)))
 
-	for i := 0; i < int(messageCount); i++ {
-		// TODO: Should reset object tables here
+	for i := 0; i < int(messageCount) && !cxt.errored(); i++ {
+		cxt.resetTables()
 
-		message := &result.Messages[i]
+		message := AmfMessage{}
+
+		cxt.pushPathName("messages")
+		cxt.pushPathIndex(i)
 
 		message.TargetUri = cxt.ReadString()
 		message.ResponseUri = cxt.ReadString()
 
 		messageLength := cxt.ReadUint32()
 
-		is_request := true
-
-		// TODO: Check targetUri to see if this isn't an array?
-
-		if is_request {
-			// Read an array, however this array is strange because it doesn't use
-			// the reference bit.
-			typeCode := cxt.ReadUint8()
-			if typeCode != 9 {
-				return nil, os.NewError("Expected Array type code in message body")
-			}
-			ref := cxt.ReadUint32()
-			itemCount := int(ref)
-			args := make([]interface{}, itemCount)
-			for i := 0; i < itemCount; i++ {
-				args[i] = cxt.ReadValue()
-			}
-			message.Body = args
-		} else {
-			message.Body = cxt.ReadValue()
-		}
+		// A request body is normally a strict array of arguments.
+		cxt.pushPathName("body")
+		message.Body = cxt.readValueAmf0()
+		cxt.popPath()
+
+		cxt.popPath()
+		cxt.popPath()
 
 		unused(messageLength)
+		result.Messages = append(result.Messages, message)
 	}
 
+	if cxt.errored() {
+		return nil, cxt.decodeError
+	}
 	return &result, nil
 }
 
+// The length written for a header or body that's too long for the length field.
+const unknownLength = 0xffffffff
+
+// Write a message bundle. Header and body values are written as AMF3 (after the
+// avmplus type marker) if bundle.AmfVersion is 3, and as AMF0 otherwise.
 func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) os.Error {
 	cxt.WriteUint16(bundle.AmfVersion)
 
@@ -182,6 +191,9 @@ func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) os.Error {
 	for _, header := range bundle.Headers {
 		cxt.WriteString(header.Name)
 		cxt.WriteBool(header.MustUnderstand)
+		if err := cxt.writeEnvelopeValue(bundle.AmfVersion, header.Value); err != nil {
+			return err
+		}
 	}
 
 	// Write messages
@@ -189,10 +201,44 @@ func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) os.Error {
 	for _, message := range bundle.Messages {
 		cxt.WriteString(message.TargetUri)
 		cxt.WriteString(message.ResponseUri)
-		cxt.WriteUint32(0)
-
-		cxt.WriteValueAmf3(message.Body)
+		if err := cxt.writeEnvelopeValue(bundle.AmfVersion, message.Body); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// Write the length and data of a header or body value. Each value is written with
+// fresh reference tables, so it's encoded separately to find its length.
+func (cxt *Encoder) writeEnvelopeValue(amfVersion uint16, value interface{}) os.Error {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	encoder := cxt.valueEncoder(buffer)
+
+	var err os.Error
+	if amfVersion == 3 {
+		encoder.writeByte(amf0_avmPlusObjectType)
+		err = encoder.WriteValueAmf3(value)
+	} else {
+		err = encoder.WriteValueAmf0(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	length := uint32(unknownLength)
+	if int64(buffer.Len()) < unknownLength {
+		length = uint32(buffer.Len())
+	}
+	cxt.WriteUint32(length)
+	return cxt.WriteBytes(buffer.Bytes())
+}
+
+// Returns an encoder with the same settings as this one and empty reference
+// tables, writing to stream.
+func (cxt *Encoder) valueEncoder(stream Writer) *Encoder {
+	encoder := *cxt
+	encoder.stream = stream
+	encoder.resetTables()
+	return &encoder
+}
@@ -3,7 +3,6 @@ package amf
 import (
 	"bytes"
 	"encoding/hex"
-	"fmt"
 	"os"
 	"testing"
 )
@@ -142,8 +141,52 @@ func TestDecodeExampleRequest2(t *testing.T) {
 		t.Error("Wrong destination")
 	}
 
-	bodyStr := fmt.Sprintf("%v", frm.Body)
-	if bodyStr != "[true 5 map[name:Sam cats:5]]" {
-		t.Error("Wrong message body: %s", bodyStr)
+	// Compare the map's entries directly, since the order it prints in isn't fixed.
+	body := frm.Body
+	if len(body) != 3 || body[0] != "true" || body[1] != "5" {
+		t.Errorf("Wrong message body: %v", frm.Body)
+		return
+	}
+	if arg, _ := body[2].(map[string]interface{}); len(arg) != 2 || arg["name"] != "Sam" ||
+		arg["cats"] != int32(5) {
+		t.Errorf("Wrong message body: %v", frm.Body)
+	}
+}
+
+func testEncodeMessageBundle(t *testing.T, bundle *MessageBundle, expectedBlob string) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := EncodeMessageBundle(NewEncoder(buffer), bundle); err != nil {
+		t.Errorf("EncodeMessageBundle returned error: %v", err)
+	}
+	blob := hex.EncodeToString(buffer.Bytes())
+	if blob != expectedBlob {
+		t.Errorf("Encoded bundle '%s' didn't match expected '%s'", blob, expectedBlob)
+	}
+
+	// The encoded bundle should read back the same way.
+	result, err := DecodeMessageBundle(buffer)
+	if err != nil {
+		t.Errorf("DecodeMessageBundle returned error: %v", err)
+		return
 	}
+	if result.Headers[0].Value != "x" || result.Messages[0].TargetUri != "/1/onResult" {
+		t.Errorf("Wrong decoded bundle: %v", result)
+	}
+}
+
+func TestEncodeMessageBundle(t *testing.T) {
+	bundle := &MessageBundle{}
+	bundle.Headers = []Header{{"Credentials", false, "x"}}
+	bundle.Messages = []AmfMessage{{"/1/onResult", "null", []interface{}{"ok"}}}
+
+	// AMF0 values, with their lengths.
+	testEncodeMessageBundle(t, bundle, "0000"+
+		"0001"+"000b43726564656e7469616c73"+"00"+"00000004"+"02000178"+
+		"0001"+"000b2f312f6f6e526573756c74"+"00046e756c6c"+"0000000a"+"0a00000001"+"0200026f6b")
+
+	// AMF3 values, after the avmplus type marker.
+	bundle.AmfVersion = 3
+	testEncodeMessageBundle(t, bundle, "0003"+
+		"0001"+"000b43726564656e7469616c73"+"00"+"00000004"+"11060378"+
+		"0001"+"000b2f312f6f6e526573756c74"+"00046e756c6c"+"00000008"+"1109030106056f6b")
 }